@@ -2,7 +2,6 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"errors"
 	"linkrouter/internal/config"
 	"linkrouter/internal/dialogs"
@@ -10,7 +9,6 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"syscall"
 
@@ -85,6 +83,8 @@ func (a *App) SaveConfigAs(cfg *config.Config) (string, error) {
 		DefaultFilename: "linkrouter.json",
 		Filters: []runtime.FileFilter{
 			{DisplayName: "JSON Files (*.json)", Pattern: "*.json"},
+			{DisplayName: "YAML Files (*.yaml)", Pattern: "*.yaml;*.yml"},
+			{DisplayName: "TOML Files (*.toml)", Pattern: "*.toml"},
 		},
 	})
 	if err != nil {
@@ -93,7 +93,9 @@ func (a *App) SaveConfigAs(cfg *config.Config) (string, error) {
 	if filePath == "" {
 		return "", nil
 	}
-	if !strings.HasSuffix(strings.ToLower(filePath), ".json") {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".json", ".yaml", ".yml", ".toml":
+	default:
 		filePath += ".json"
 	}
 
@@ -109,26 +111,112 @@ func (a *App) GetCurrentConfigPath() string {
 	return configPath
 }
 
-func (a *App) IsValidRegex(regexStr string) string {
-	if regexStr == "" {
+// IsValidRegex validates the regex and structured URL conditions of a rule
+func (a *App) IsValidRegex(rule config.Rule) string {
+	if rule.Regex == "" && rule.URLMatcher.IsEmpty() {
 		return ""
 	}
-	_, err := regexp.Compile(regexStr)
-	if err != nil {
+	if err := rule.Validate(); err != nil {
 		return err.Error()
 	}
 	return ""
 }
 
-func (a *App) TestRegex(regexStr, url string) bool {
-	if regexStr == "" {
+func (a *App) TestRegex(rule config.Rule, url string) bool {
+	if rule.Regex == "" && rule.URLMatcher.IsEmpty() {
 		return false
 	}
-	re, err := regexp.Compile(regexStr)
+	matches, err := rule.Match(url)
 	if err != nil {
 		return false
 	}
-	return re.MatchString(url)
+	return len(matches) > 0
+}
+
+// ExplainURL routes url through cfg without launching anything and returns
+// the decision with the outcome of every rule evaluated.
+// When cfg is nil the saved config is used. The active profile is applied.
+func (a *App) ExplainURL(cfg *config.Config, url string) (*launcher.Decision, error) {
+	if cfg == nil {
+		var err error
+		cfg, err = config.LoadConfig()
+		if err != nil {
+			return nil, err
+		}
+	}
+	cfg.ApplyActiveProfile()
+	return launcher.Route(cfg, url, true), nil
+}
+
+// Profiles are the profiles of the saved config and the active one
+type Profiles struct {
+	Names  []string `json:"names"`
+	Active string   `json:"active"`
+}
+
+// GetProfiles lists the profiles of the saved config
+func (a *App) GetProfiles() (*Profiles, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, err
+	}
+	return &Profiles{Names: cfg.ProfileNames(), Active: config.LoadState().Profile}, nil
+}
+
+// SetActiveProfile makes name the profile applied to links from now on, "" for none
+func (a *App) SetActiveProfile(name string) error {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return err
+	}
+	return cfg.SetActiveProfile(name)
+}
+
+// ListApps returns the names of the apps of cfg, which may be unsaved
+func (a *App) ListApps(cfg *config.Config) []string {
+	if cfg == nil {
+		return nil
+	}
+	return cfg.AppNames()
+}
+
+// CreateApp adds app name to cfg and returns the changed config
+func (a *App) CreateApp(cfg *config.Config, name string, app config.App) (*config.Config, error) {
+	if cfg == nil {
+		return nil, errors.New("config is nil")
+	}
+	if err := cfg.AddApp(name, app); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RenameApp renames an app of cfg along with the rules, profiles and
+// fallback browser using it, and returns the changed config
+func (a *App) RenameApp(cfg *config.Config, from, to string) (*config.Config, error) {
+	if cfg == nil {
+		return nil, errors.New("config is nil")
+	}
+	if err := cfg.RenameApp(from, to); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// RunSelfTest runs inline rule tests on cfg, which may be unsaved
+func (a *App) RunSelfTest(cfg *config.Config) (*launcher.TestReport, error) {
+	if cfg == nil {
+		return nil, errors.New("config is nil")
+	}
+	return launcher.SelfTest(cfg), nil
+}
+
+// LintConfig reports broken, duplicate, shadowed and overly broad rules in cfg
+func (a *App) LintConfig(cfg *config.Config) ([]launcher.LintIssue, error) {
+	if cfg == nil {
+		return nil, errors.New("config is nil")
+	}
+	return launcher.Lint(cfg), nil
 }
 
 func (a *App) OpenFileDialog(title string, filters []runtime.FileFilter) (string, error) {
@@ -158,7 +246,7 @@ func (a *App) OpenFileDialog(title string, filters []runtime.FileFilter) (string
 // For config files
 func (a *App) OpenConfigDialog() (string, error) {
 	return a.OpenFileDialog("Select LinkRouter Config File", []runtime.FileFilter{
-		{DisplayName: "JSON Files (*.json)", Pattern: "*.json"},
+		{DisplayName: "Config Files (*.json, *.yaml, *.toml)", Pattern: "*.json;*.yaml;*.yml;*.toml"},
 		{DisplayName: "All Files (*.*)", Pattern: "*.*"},
 	})
 }
@@ -173,17 +261,7 @@ func (a *App) OpenProgramDialog() (string, error) {
 
 // LoadConfigFromPath loads config from a user-selected path
 func (a *App) LoadConfigFromPath(path string) (*config.Config, error) {
-	data, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
-
-	var cfg config.Config
-	if err := json.Unmarshal(data, &cfg); err != nil {
-		return nil, err
-	}
-
-	return &cfg, nil
+	return config.ReadConfig(path)
 }
 
 func getExePath() string {
@@ -240,7 +318,19 @@ func (a *App) OpenInFallbackBrowser(browserPath string, argsTemplate string, url
 			"go to settings and set it up")
 		return
 	}
-	err := launcher.LaunchApp(browserPath, argsTemplate, url)
+	// placeholders are escaped by the template, quotes around the link
+	// would end up in it
+	link := config.ParseLink(strings.Trim(strings.TrimSpace(url), `"`))
+	// variables and apps come from the saved config
+	var l *config.Launch
+	cfg, err := config.LoadConfig()
+	if err == nil {
+		f := config.NewFallback(browserPath, argsTemplate)
+		l, err = cfg.FallbackLaunch(&f)
+	}
+	if err == nil {
+		err = launcher.LaunchApp(l, launcher.TemplateContext(link, nil, nil))
+	}
 	if err != nil {
 		dialogs.ShowError("unable to launch fallback browser: \n" + err.Error())
 	}
@@ -260,27 +350,28 @@ func (a *App) OpenConfigInExplorer(configPath string) error {
 	return cmd.Start()
 }
 
-type Rule struct {
-	Regex     string `json:"regex"`
-	Program   string `json:"program"`
-	Arguments string `json:"arguments"`
-}
-
-func (a *App) TestRule(rule Rule, url string) error {
+func (a *App) TestRule(rule config.Rule, url string) error {
 	go func() {
-		re, err := regexp.Compile(rule.Regex)
+		matches, err := rule.Match(url)
 		if err != nil {
-			dialogs.ShowError("Unable to complie regex:\n" + err.Error())
+			dialogs.ShowError("Unable to complie rule:\n" + err.Error())
 			return
 		}
-		matches := re.FindStringSubmatch(url)
 
 		if len(matches) == 0 {
-			dialogs.ShowError("Test URL doesn't match regex")
+			dialogs.ShowError("Test URL doesn't match rule")
 		}
 
-		expandedArgs := launcher.ExpandPlaceholders(rule.Arguments, matches)
-		err = launcher.LaunchApp(rule.Program, expandedArgs, url)
+		link := config.ParseLink(url)
+		// variables and apps come from the saved config
+		var l *config.Launch
+		cfg, err := config.LoadConfig()
+		if err == nil {
+			l, err = cfg.RuleLaunch(&rule)
+		}
+		if err == nil {
+			err = launcher.LaunchApp(l, launcher.TemplateContext(link, &rule, matches))
+		}
 		if err != nil {
 			dialogs.ShowError("Unable to launch program:\n" + err.Error())
 		}
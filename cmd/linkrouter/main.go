@@ -3,7 +3,9 @@ package main
 
 import (
 	"flag"
+	"os"
 
+	"linkrouter/internal/console"
 	"linkrouter/internal/dialogs"
 	"linkrouter/internal/globals"
 	"linkrouter/internal/launcher"
@@ -19,6 +21,20 @@ func main() {
 	version := flag.Bool("version", false, "Show version")
 	edit := flag.Bool("edit", false, "Edit config")
 	showDefaultApps := flag.Bool("default-apps", false, "Show default apps dialog")
+	resolve := flag.String("resolve", "", "Print how URL would be routed without launching anything")
+	explain := flag.String("explain", "", "Like --resolve, also print the outcome of every rule evaluated")
+	selftest := flag.Bool("selftest", false, "Run inline rule tests and print a pass/fail report")
+	lint := flag.Bool("lint", false, "Report invalid, duplicate, shadowed and overly broad rules")
+	convert := flag.String("convert-config", "", "Write the config to the given .json, .yaml or .toml file")
+	migrate := flag.Bool("migrate", false, "Upgrade the config to the current format and print the diff")
+	dryRun := flag.Bool("dry-run", false, "With --migrate, print the diff without writing anything")
+	resetFallbacks := flag.Bool("reset-fallbacks", false, "Forget which fallback browsers failed to start")
+	asJSON := flag.Bool("json", false, "Print --resolve/--explain/--selftest/--lint output as JSON")
+	var profile *string
+	flag.Func("profile", "Switch to the named profile, empty for none", func(name string) error {
+		profile = &name
+		return nil
+	})
 	flag.Parse()
 
 	args := flag.Args()
@@ -35,6 +51,72 @@ func main() {
 		return
 	}
 
+	if profile != nil {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.SetProfile(*profile, os.Stdout)
+		// with a link or another command, that runs in the new profile
+		hasURL := len(args) == 1 && launcher.IsCorrectURL(args[0])
+		if code != 0 || !hasURL && !hasCommand() {
+			logger.Close()
+			os.Exit(code)
+		}
+		globals.QuietMode = *quiet
+	}
+
+	if *resolve != "" || *explain != "" {
+		// dry-run reports to stdout, never with popups
+		globals.QuietMode = true
+		console.Attach()
+		url := *resolve
+		if *explain != "" {
+			url = *explain
+		}
+		code := launcher.Resolve(url, *explain != "", *asJSON, os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
+	if *selftest {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.RunSelfTest(*asJSON, os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
+	if *lint {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.RunLint(*asJSON, os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
+	if *convert != "" {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.ConvertConfig(*convert, os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
+	if *migrate {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.MigrateConfig(*dryRun, os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
+	if *resetFallbacks {
+		globals.QuietMode = true
+		console.Attach()
+		code := launcher.ResetFallbacks(os.Stdout)
+		logger.Close()
+		os.Exit(code)
+	}
+
 	if *edit {
 		launcher.EditConfig()
 		return
@@ -59,11 +141,25 @@ func main() {
 	}
 
 	if len(args) == 1 && launcher.IsCorrectURL(args[0]) {
-		launcher.HandleURL(args[0])
-		defer logger.Close()
-		return
+		code := launcher.HandleURL(args[0])
+		logger.Close()
+		os.Exit(code)
 	}
 
 	launcher.HandleNoArgs()
 	defer logger.Close()
 }
+
+// hasCommand tells if a flag other than --profile and those only modifying a
+// command, like --quiet, was given
+func hasCommand() bool {
+	found := false
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "profile", "quiet", "json", "dry-run":
+		default:
+			found = true
+		}
+	})
+	return found
+}
@@ -3,8 +3,10 @@ module linkrouter
 go 1.25.5
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/wailsapp/wails/v2 v2.11.0
 	golang.org/x/sys v0.30.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -0,0 +1,124 @@
+package config
+
+import "fmt"
+
+// Action types, see Rule.Actions
+const (
+	ActionLaunch          = "launch"
+	ActionCopyToClipboard = "copyToClipboard"
+	ActionAppendToFile    = "appendToFile"
+	ActionNotify          = "notify"
+	ActionBlock           = "block"
+	ActionOpenFallback    = "openFallback"
+)
+
+// Rule.OnFailure policies
+const (
+	// OnFailureFallback shows the error and goes on as if no rule matched
+	OnFailureFallback = "fallback"
+	// OnFailureError shows the error and stops
+	OnFailureError = "error"
+	// OnFailureNextRule goes on matching with the next rule, quietly
+	OnFailureNextRule = "nextRule"
+)
+
+// FailurePolicy returns the onFailure policy of the rule, fallback when unset
+func (r *Rule) FailurePolicy() string {
+	if r.OnFailure == "" {
+		return OnFailureFallback
+	}
+	return r.OnFailure
+}
+
+// Action is one step of a rule with actions. Text values are templates,
+// expanded without quoting as they never land on a command line.
+type Action struct {
+	// Type is one of the Action* constants, launch when empty
+	Type string `json:"type,omitempty"`
+
+	// launch starts app or program like a rule does, the rule's own when
+	// neither is set
+	App        string            `json:"app,omitempty"`
+	Program    string            `json:"program,omitempty"`
+	Arguments  string            `json:"arguments,omitempty"`
+	Args       []string          `json:"args,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+
+	// Text is copied by copyToClipboard and shown by notify, {URL} when empty
+	Text string `json:"text,omitempty"`
+	// Title of notify, LinkRouter when empty
+	Title string `json:"title,omitempty"`
+	// File gets Line appended by appendToFile, {URL} when Line is empty
+	File string `json:"file,omitempty"`
+	Line string `json:"line,omitempty"`
+	// Reason is logged and shown by block
+	Reason string `json:"reason,omitempty"`
+
+	// ContinueOnError runs the next actions even when this one fails
+	ContinueOnError bool `json:"continueOnError,omitempty"`
+}
+
+// Kind returns the type of the action, launch when it isn't set
+func (a *Action) Kind() string {
+	if a.Type == "" {
+		return ActionLaunch
+	}
+	return a.Type
+}
+
+// hasTarget tells whether a launch action names its own app or program
+func (a *Action) hasTarget() bool {
+	return a.App != "" || a.Program != ""
+}
+
+// ActionLaunch resolves what launch action a of rule starts
+func (c *Config) ActionLaunch(rule *Rule, a *Action) (*Launch, error) {
+	if !a.hasTarget() {
+		return c.RuleLaunch(rule)
+	}
+	arguments := a.Arguments
+	if len(a.Args) > 0 {
+		arguments = ""
+	}
+	return c.newLaunch(a.App, a.Program, arguments, a.Args, a.WorkingDir, a.Env)
+}
+
+// ExpandAction returns a copy of a with variables and environment variables
+// expanded in its text values. Its launch is resolved by ActionLaunch.
+func (c *Config) ExpandAction(a *Action) (*Action, error) {
+	expanded := *a
+	var err error
+	if expanded.Text, err = c.ExpandTemplate(a.Text); err != nil {
+		return nil, fmt.Errorf("text: %w", err)
+	}
+	if expanded.Title, err = c.ExpandTemplate(a.Title); err != nil {
+		return nil, fmt.Errorf("title: %w", err)
+	}
+	if expanded.File, err = c.ExpandTemplate(a.File); err != nil {
+		return nil, fmt.Errorf("file: %w", err)
+	}
+	if expanded.Line, err = c.ExpandTemplate(a.Line); err != nil {
+		return nil, fmt.Errorf("line: %w", err)
+	}
+	if expanded.Reason, err = c.ExpandTemplate(a.Reason); err != nil {
+		return nil, fmt.Errorf("reason: %w", err)
+	}
+	return &expanded, nil
+}
+
+// checkActions resolves every action of rule, as checkReferences does for
+// the rule itself
+func (c *Config) checkActions(rule *Rule) error {
+	for i := range rule.Actions {
+		a := &rule.Actions[i]
+		_, err := c.ExpandAction(a)
+		if err == nil && a.Kind() == ActionLaunch {
+			_, err = c.ActionLaunch(rule, a)
+		}
+		if err != nil {
+			return fmt.Errorf("actions[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"strings"
+)
+
+// App is a named target that rules and the fallback browser launch, so that
+// a program path and its usual arguments are kept in one place
+type App struct {
+	Program string `json:"program"`
+	// BaseArgs is an argument template placed before the arguments of the rule
+	BaseArgs   string            `json:"baseArgs,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+	WorkingDir string            `json:"workingDir,omitempty"`
+}
+
+// AppPrefix marks a reference to an app in fallbackBrowserPath, as in app:work-chrome
+const AppPrefix = "app:"
+
+// Launch is what a rule or the fallback browser starts, with its app and
+// variables resolved. Arguments and Args are still argument templates, Args
+// follow Arguments. WorkingDir and Env values may hold placeholders too.
+type Launch struct {
+	// App is the name of the app, empty for a plain program
+	App        string
+	Program    string
+	Arguments  string
+	Args       []string
+	WorkingDir string
+	Env        map[string]string
+}
+
+// newLaunch builds the launch of program with its argument templates, or of
+// app when it is set, with the app's base arguments first. workingDir and env
+// override those of the app.
+func (c *Config) newLaunch(app, program, arguments string, args []string, workingDir string, env map[string]string) (*Launch, error) {
+	l := &Launch{App: app}
+	if app != "" {
+		def, ok := c.Apps[app]
+		if !ok {
+			return nil, fmt.Errorf("unknown app %q", app)
+		}
+		program = def.Program
+		arguments = strings.TrimSpace(def.BaseArgs + " " + arguments)
+		l.WorkingDir = def.WorkingDir
+		l.Env = maps.Clone(def.Env)
+	}
+	if workingDir != "" {
+		l.WorkingDir = workingDir
+	}
+	if len(env) > 0 {
+		if l.Env == nil {
+			l.Env = map[string]string{}
+		}
+		maps.Copy(l.Env, env)
+	}
+
+	var err error
+	if l.Program, err = c.ExpandPath(program); err != nil {
+		return nil, fmt.Errorf("program: %w", err)
+	}
+	if l.Arguments, err = c.ExpandTemplate(arguments); err != nil {
+		return nil, fmt.Errorf("arguments: %w", err)
+	}
+	l.Args = make([]string, len(args))
+	for i, arg := range args {
+		if l.Args[i], err = c.ExpandTemplate(arg); err != nil {
+			return nil, fmt.Errorf("args[%d]: %w", i, err)
+		}
+	}
+	// placeholders are expanded at launch, so ${NAME} is a capture group here
+	if l.WorkingDir, err = c.ExpandTemplate(l.WorkingDir); err != nil {
+		return nil, fmt.Errorf("workingDir: %w", err)
+	}
+	for name, value := range l.Env {
+		if l.Env[name], err = c.ExpandTemplate(value); err != nil {
+			return nil, fmt.Errorf("env %s: %w", name, err)
+		}
+	}
+	return l, nil
+}
+
+// RuleLaunch resolves what rule launches
+func (c *Config) RuleLaunch(rule *Rule) (*Launch, error) {
+	arguments := rule.Arguments
+	if len(rule.Args) > 0 {
+		// Args replaces Arguments
+		arguments = ""
+	}
+	return c.newLaunch(rule.App, rule.Program, arguments, rule.Args, rule.WorkingDir, rule.Env)
+}
+
+// AppNames returns the names of the apps, sorted
+func (c *Config) AppNames() []string {
+	return sortedKeys(c.Apps)
+}
+
+// AddApp adds a new app called name
+func (c *Config) AddApp(name string, app App) error {
+	if strings.TrimSpace(name) == "" {
+		return fmt.Errorf("app name is empty")
+	}
+	if _, ok := c.Apps[name]; ok {
+		return fmt.Errorf("app %q already exists", name)
+	}
+	if c.Apps == nil {
+		c.Apps = map[string]App{}
+	}
+	c.Apps[name] = app
+	return nil
+}
+
+// RenameApp renames an app and every reference to it, in rules, profiles and
+// the fallback browsers. Rules of read-only files can't be changed, so an app
+// they use can't be renamed.
+func (c *Config) RenameApp(from, to string) error {
+	app, ok := c.Apps[from]
+	switch {
+	case !ok:
+		return fmt.Errorf("unknown app %q", from)
+	case strings.TrimSpace(to) == "":
+		return fmt.Errorf("app name is empty")
+	case to == from:
+		return nil
+	}
+	if _, ok := c.Apps[to]; ok {
+		return fmt.Errorf("app %q already exists", to)
+	}
+	for _, f := range c.Includes {
+		if !f.ReadOnly {
+			continue
+		}
+		for _, rule := range c.Rules {
+			if rule.File == f.Path && rule.App == from {
+				return fmt.Errorf("app %q is used by read-only %s", from, f.Path)
+			}
+		}
+	}
+
+	rename := func(rules []Rule) {
+		for i := range rules {
+			if rules[i].App == from {
+				rules[i].App = to
+			}
+		}
+	}
+	renameFallbacks := func(fallbacks []Fallback) bool {
+		renamed := false
+		for i := range fallbacks {
+			if fallbacks[i].App == from {
+				fallbacks[i].App = to
+				renamed = true
+			}
+		}
+		return renamed
+	}
+	rename(c.Rules)
+	for _, p := range c.Profiles {
+		rename(p.Rules)
+		if string(p.Global["fallbackBrowserPath"]) == fmt.Sprintf("%q", AppPrefix+from) {
+			p.Global["fallbackBrowserPath"] = []byte(fmt.Sprintf("%q", AppPrefix+to))
+		}
+		var fallbacks []Fallback
+		if json.Unmarshal(p.Global["fallbacks"], &fallbacks) == nil && renameFallbacks(fallbacks) {
+			p.Global["fallbacks"], _ = json.Marshal(fallbacks)
+		}
+	}
+	if c.Global.FallbackBrowserPath == AppPrefix+from {
+		c.Global.FallbackBrowserPath = AppPrefix + to
+	}
+	renameFallbacks(c.Global.Fallbacks)
+	delete(c.Apps, from)
+	c.Apps[to] = app
+	return nil
+}
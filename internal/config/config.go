@@ -10,6 +10,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
 
 	"golang.org/x/sys/windows/registry"
@@ -19,8 +20,33 @@ var SupportedProtocols []string
 
 // Config represents the full configuration
 type Config struct {
-	Global GlobalConfig `json:"global"`
-	Rules  []Rule       `json:"rules"`
+	// Schema is kept so editors keep finding linkrouter.schema.json after a save
+	Schema string `json:"$schema,omitempty"`
+	// SchemaVersion is the config format, see ConfigVersion and Migrate
+	SchemaVersion int          `json:"schemaVersion,omitempty"`
+	Global        GlobalConfig `json:"global"`
+	Rules         []Rule       `json:"rules"`
+	// Variables are referenced as ${var.name} in programs, arguments,
+	// fallbackBrowserPath and logPath, see ExpandPath
+	Variables map[string]string `json:"variables,omitempty"`
+	// Apps are launch targets shared by rules and the fallback browser
+	Apps map[string]App `json:"apps,omitempty"`
+	// Profiles change settings and rules by name, see ApplyProfile
+	Profiles map[string]Profile `json:"profiles,omitempty"`
+
+	// Problems found while loading, see validateConfig
+	Problems []Problem `json:"-"`
+	// Includes are the files rules were merged from. Set when loading,
+	// never written to the config.
+	Includes []IncludeFile `json:"includes,omitempty"`
+	// Layers are the config files merged, machine first, see ReadLayered.
+	// Provenance tells which of them each global setting comes from.
+	// Both are set when loading, never written to the config.
+	Layers     []Layer               `json:"layers,omitempty"`
+	Provenance map[string]Provenance `json:"provenance,omitempty"`
+
+	compiled []*compiledRule
+	extra    extraFields
 }
 
 // GlobalConfig holds global settings
@@ -31,17 +57,133 @@ type GlobalConfig struct {
 	LogPath             string   `json:"logPath"`
 	InteractiveMode     bool     `json:"interactiveMode"`
 	SupportedProtocols  []string `json:"supportedProtocols"`
+	// Fallbacks are tried in order after FallbackBrowserPath when it fails
+	// to start, see Config.Fallbacks
+	Fallbacks []Fallback `json:"fallbacks,omitempty"`
+	// FallbackWorkingDir and FallbackEnv are the workingDir and env of the
+	// fallback browsers, see Rule
+	FallbackWorkingDir string            `json:"fallbackWorkingDir,omitempty"`
+	FallbackEnv        map[string]string `json:"fallbackEnv,omitempty"`
+	// Include lists files or globs, relative to the config, with more rules
+	Include []string `json:"include,omitempty"`
+	// Locked lists settings that configs of later layers can't change
+	Locked []string `json:"locked,omitempty"`
+
+	// set holds the keys the file sets, see mergeGlobals
+	set   map[string]bool
+	extra extraFields
 }
 
-// Rule defines a URL routing rule
+// Rule defines a URL routing rule.
+// Regex and structured URL conditions may be combined, all of them must match.
 type Rule struct {
-	Regex       string `json:"regex"`
-	Program     string `json:"program"`
-	Arguments   string `json:"arguments"`
-	Interactive bool   `json:"interactive,omitempty"`
+	// Name identifies the rule for profiles, optional
+	Name  string `json:"name,omitempty"`
+	Regex string `json:"regex"`
+	// MatchOn is "decoded" (default) or "raw", see Link
+	MatchOn string `json:"matchOn,omitempty"`
+	URLMatcher
+	// the rule is skipped when any exclusion matches
+	Exclude []Exclusion `json:"exclude,omitempty"`
+	// App launches an app of the config instead of Program, Arguments go
+	// after its base arguments
+	App       string `json:"app,omitempty"`
+	Program   string `json:"program,omitempty"`
+	Arguments string `json:"arguments"`
+	// Args, when set, replaces Arguments. Every element becomes exactly one
+	// argument, quoted after placeholder expansion
+	Args []string `json:"args,omitempty"`
+	// WorkingDir is the directory the program starts in, Env is added to its
+	// environment. Both override those of the app and may use placeholders.
+	WorkingDir  string            `json:"workingDir,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+	Interactive bool              `json:"interactive,omitempty"`
+	// Actions run in order instead of launching the program, see Action
+	Actions []Action `json:"actions,omitempty"`
+	// OnFailure is what happens when the program or an action fails:
+	// fallback (default), error or nextRule, see FailurePolicy
+	OnFailure string `json:"onFailure,omitempty"`
+	// Tests are checked by --selftest
+	Tests *RuleTests `json:"tests,omitempty"`
+	// Locked rules stay ahead of the rules of later layers, see ReadLayered
+	Locked bool `json:"locked,omitempty"`
+	// File is the included file the rule comes from, empty for the config
+	// itself. Set when loading, never written.
+	File string `json:"file,omitempty"`
+
+	// disabled is the load problem that took the rule out of this session
+	disabled string
+	extra    extraFields
+}
+
+// RuleTests are links that must, or must not, route to the rule
+type RuleTests struct {
+	Match   []RuleTest `json:"match,omitempty"`
+	NoMatch []string   `json:"noMatch,omitempty"`
+}
+
+// RuleTest is a link that must route to the rule. Args, when set, is the expected
+// expanded arguments line. In JSON it is either a plain URL string or an object.
+type RuleTest struct {
+	URL  string `json:"url"`
+	Args string `json:"args,omitempty"`
+}
+
+func (t *RuleTest) UnmarshalJSON(data []byte) error {
+	var url string
+	if err := json.Unmarshal(data, &url); err == nil {
+		*t = RuleTest{URL: url}
+		return nil
+	}
+	type plain RuleTest
+	return json.Unmarshal(data, (*plain)(t))
+}
+
+func (t RuleTest) MarshalJSON() ([]byte, error) {
+	if t.Args == "" {
+		return json.Marshal(t.URL)
+	}
+	type plain RuleTest
+	return json.Marshal(plain(t))
+}
+
+// Exclusion is a regex and/or structured URL conditions that must NOT match.
+// In JSON it is either a plain regex string or an object.
+type Exclusion struct {
+	Regex string `json:"regex,omitempty"`
+	URLMatcher
+}
+
+func (e *Exclusion) UnmarshalJSON(data []byte) error {
+	var regex string
+	if err := json.Unmarshal(data, &regex); err == nil {
+		*e = Exclusion{Regex: regex}
+		return nil
+	}
+	type plain Exclusion
+	return json.Unmarshal(data, (*plain)(e))
+}
+
+func (e Exclusion) MarshalJSON() ([]byte, error) {
+	if e.URLMatcher.IsEmpty() {
+		return json.Marshal(e.Regex)
+	}
+	type plain Exclusion
+	return json.Marshal(plain(e))
+}
+
+func (e Exclusion) String() string {
+	data, _ := e.MarshalJSON()
+	return string(data)
 }
 
 func getDefaultBrowserPath() string {
+	return findDefaultBrowser(true)
+}
+
+// findDefaultBrowser looks up the default browser, see SystemBrowserPath.
+// With warn it tells when LinkRouter is the default.
+func findDefaultBrowser(warn bool) string {
 	// try to get default browser from registry
 	// Step 1: Get ProgId from UserChoice for .html
 	logger.Log("Trying to get default system browser.")
@@ -71,9 +213,11 @@ func getDefaultBrowserPath() string {
 			logger.Log("Found " + matches[1])
 			return matches[1]
 		}
-		if utils.IsLinkRouter(matches[1]) {
+		if len(matches) > 1 {
 			logger.Log("LinkRouter is already set as default browser. Trying to guess fallback browser.")
-			dialogs.ShowError("LinkRouter is already set as default browser. Trying to guess fallback browser.")
+			if warn {
+				dialogs.ShowError("LinkRouter is already set as default browser. Trying to guess fallback browser.")
+			}
 		}
 	}
 
@@ -151,6 +295,17 @@ func isProgramFiles(path string) bool {
 		strings.HasPrefix(strings.ToLower(path), strings.ToLower(progFilesX86))
 }
 
+// findConfig returns the first config of any format in dir, or ""
+func findConfig(dir string) string {
+	for _, name := range configNames {
+		candidate := filepath.Join(dir, name)
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate
+		}
+	}
+	return ""
+}
+
 func GetConfigPath() string {
 	exe, _ := os.Executable()
 	exeDir := filepath.Dir(exe)
@@ -158,16 +313,19 @@ func GetConfigPath() string {
 
 	localAppData := os.Getenv("LOCALAPPDATA")
 	if localAppData == "" {
+		if found := findConfig(exeDir); found != "" {
+			return found
+		}
 		return candidateExe
 	}
 	candidateAppData := filepath.Join(localAppData, "LinkRouter", "linkrouter.json")
 
 	// Prefer AppData if exists
-	if _, err := os.Stat(candidateAppData); err == nil {
-		return candidateAppData
+	if found := findConfig(filepath.Dir(candidateAppData)); found != "" {
+		return found
 	}
-	if _, err := os.Stat(candidateExe); err == nil {
-		return candidateExe
+	if found := findConfig(exeDir); found != "" {
+		return found
 	}
 
 	// No config exists exist. Try exedir first if not in ProgramFiles (portable mode)
@@ -215,6 +373,7 @@ func DefaultConfig() *Config {
 	}
 
 	return &Config{
+		SchemaVersion: ConfigVersion,
 		Global: GlobalConfig{
 			FallbackBrowserPath: browserPath,
 			FallbackBrowserArgs: "\"{URL}\"",
@@ -237,62 +396,161 @@ func DefaultConfig() *Config {
 func LoadConfig() (*Config, error) {
 	configPath := GetConfigPath()
 
-	data, err := os.ReadFile(configPath)
-	if os.IsNotExist(err) {
-		cfg := DefaultConfig()
-		cfg.Save(configPath)
-		return cfg, nil
-	}
-	if err != nil {
-		return nil, err
+	if _, err := os.Stat(configPath); os.IsNotExist(err) {
+		if len(configLayers(configPath)) == 1 {
+			cfg := DefaultConfig()
+			cfg.Save(configPath)
+			return cfg, nil
+		}
+		// settings and rules come from the other layers
+		writeEmptyConfig(configPath)
 	}
 
-	var cfg Config
-	err = json.Unmarshal(data, &cfg)
+	// an older config is upgraded before it is read; when that fails it is
+	// loaded as is, settings it has are still understood
+	migrated, errMigrate := Migrate(configPath, false)
+
+	cfg, err := ReadLayered(configPath)
 	if err != nil {
+		logger.Log("Error: " + err.Error())
 		return nil, err
 	}
-	err_init := logger.Init(cfg.Global.LogPath)
+	logPath, err_init := cfg.ExpandPath(cfg.Global.LogPath)
+	if err_init == nil {
+		err_init = logger.Init(logPath)
+	}
 	if err_init != nil {
 		logger.Log(fmt.Sprintf("Error: can't open global.logPath %q, %s", cfg.Global.LogPath, err_init))
 		dialogs.ShowError(fmt.Sprintf("can't open global.logPath %q, %s", cfg.Global.LogPath, err_init))
 	}
+	if errMigrate != nil {
+		logger.Log(fmt.Sprintf("Error: can't upgrade config to version %d, %s", ConfigVersion, errMigrate))
+	} else if migrated.From != migrated.To {
+		logger.Log(fmt.Sprintf("Config upgraded from version %d to %d (%s), original saved as %s",
+			migrated.From, migrated.To, strings.Join(migrated.Steps, "; "), migrated.Backup))
+	}
+	reportProblems(configPath, cfg)
 
-	cfg.Global.FallbackBrowserPath, _ = utils.LookupInPATH(cfg.Global.FallbackBrowserPath)
-	cfg.Global.DefaultConfigEditor, _ = utils.LookupInPATH(cfg.Global.DefaultConfigEditor)
+	cfg.Global.lookupPrograms()
 
-	if utils.IsLinkRouter(cfg.Global.FallbackBrowserPath) {
+	if fallback, _ := cfg.ExpandPath(cfg.Global.FallbackBrowserPath); utils.IsLinkRouter(fallback) {
 		dialogs.ShowError("Fallback browser is set to LinkRouter itself.\nTrying to guess fallback browser.")
 		logger.Log("Error: Fallback browser is set to LinkRouter itself. Trying to guess fallback browser.")
 		cfg.Global.FallbackBrowserPath = getDefaultBrowserPath()
 	}
 
 	SupportedProtocols = cfg.Global.SupportedProtocols
+	cfg.loadCompiledRules(configPath)
 
-	return &cfg, nil
+	return cfg, nil
 }
 
+// ReadConfig parses and validates a config file and the files it includes
+// without applying them. The format is picked by extension, problems are left
+// in cfg.Problems.
+func ReadConfig(path string) (*Config, error) {
+	cfg, locate, err := readConfigFile(path, false)
+	if err != nil {
+		return nil, err
+	}
+	cfg.readIncludes(path, locate)
+	return cfg, nil
+}
+
+// readConfigFile parses and validates a single file, the config or, with
+// include, one of the files it includes. locate maps a JSON path of the file
+// to its line and column.
+func readConfigFile(path string, include bool) (*Config, func(string) (int, int), error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var tree *jsonNode
+	data, locate, err := formatOf(path).toJSON(data)
+	if err == nil {
+		tree, err = parseJSON(data)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	file := ""
+	if include {
+		file = path
+	}
+	cfg.Problems = validateConfig(data, tree, cfg, file)
+	if locate == nil {
+		return cfg, func(p string) (int, int) { return locateJSON(data, tree, p) }, nil
+	}
+	for i := range cfg.Problems {
+		cfg.Problems[i].Line, cfg.Problems[i].Column = locate(cfg.Problems[i].Path)
+	}
+	return cfg, locate, nil
+}
+
+// Save writes the config in the format of path. When path already holds a
+// JSON or YAML config, its comments, formatting and key order are kept and
+// only changed values are rewritten, and fields it doesn't have are only
+// added when they aren't empty. Rules of included files and other layers
+// are written back to them, unless they are read-only. Global settings the
+// file doesn't set yet are only written when they differ from what the other
+// layers give.
 func (c *Config) Save(path string) error {
-	data, err := json.MarshalIndent(c, "", "  ")
+	own, err := c.saveIncludes()
+	if err != nil {
+		return err
+	}
+	main := *c
+	main.Rules = own
+	main.Includes = nil
+	main.Layers, main.Provenance = nil, nil
+	data, err := json.MarshalIndent(main, "", "  ")
+	if err != nil {
+		return err
+	}
+	if len(c.Layers) > 1 {
+		if data, err = c.dropInherited(data, path); err != nil {
+			return err
+		}
+	}
+	original, err := os.ReadFile(path)
+	if err != nil {
+		original = nil
+	} else if stripped, _, err := formatOf(path).toJSON(original); err == nil {
+		if data, err = omitAddedZeros(data, stripped, len(c.Layers) > 1); err != nil {
+			return err
+		}
+	}
+	data, err = formatOf(path).fromJSON(data, original)
 	if err != nil {
 		return err
 	}
 	return os.WriteFile(path, data, 0600)
 }
 
-func (c *Config) MatchRule(url string) (*Rule, []string, int) {
-	for i, rule := range c.Rules {
-		re, err := regexp.Compile(rule.Regex)
-		if err != nil {
-			logger.Log("Invalid regex: " + err.Error())
-			logger.Log(fmt.Sprintf("Failed rule: regex=%q", rule.Regex))
-			dialogs.ShowError("invalid regex:\n" + err.Error())
-			continue
-		}
-		if matches := re.FindStringSubmatch(url); len(matches) > 0 {
-			return &rule, matches, i
+// lookupPrograms resolves programs given by name only through PATH
+func (g *GlobalConfig) lookupPrograms() {
+	if !strings.HasPrefix(g.FallbackBrowserPath, AppPrefix) {
+		g.FallbackBrowserPath, _ = utils.LookupInPATH(g.FallbackBrowserPath)
+	}
+	g.Fallbacks = slices.Clone(g.Fallbacks)
+	for i := range g.Fallbacks {
+		if g.Fallbacks[i].Program != "" {
+			g.Fallbacks[i].Program, _ = utils.LookupInPATH(g.Fallbacks[i].Program)
 		}
 	}
-	logger.Log("Matched rule: None")
+	g.DefaultConfigEditor, _ = utils.LookupInPATH(g.DefaultConfigEditor)
+}
+
+func (c *Config) MatchRule(link *Link) (*Rule, []string, int) {
+	trace := c.Explain(link)
+	ReportTrace(trace, true)
+	if t := Matched(trace); t != nil {
+		matched := c.Rules[t.Index]
+		return &matched, t.Groups, t.Index
+	}
 	return nil, nil, -1
 }
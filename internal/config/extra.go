@@ -0,0 +1,167 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Keys LinkRouter doesn't know, written by a newer version or added by hand as
+// annotations, are kept in extra and written back unchanged on save.
+type extraFields map[string]json.RawMessage
+
+// jsonKeys returns the JSON keys of struct type t, including embedded structs
+func jsonKeys(t reflect.Type) map[string]bool {
+	keys := map[string]bool{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			for key := range jsonKeys(f.Type) {
+				keys[key] = true
+			}
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+		if name == "-" || !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		keys[name] = true
+	}
+	return keys
+}
+
+// jsonFieldType returns the type of the field of struct type t that the JSON
+// key name decodes to, including fields of embedded structs, or nil
+func jsonFieldType(t reflect.Type, name string) reflect.Type {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if f.Anonymous && tag == "" {
+			if ft := jsonFieldType(f.Type, name); ft != nil {
+				return ft
+			}
+			continue
+		}
+		key, _, _ := strings.Cut(tag, ",")
+		if key == "" {
+			key = f.Name
+		}
+		if key == name && key != "-" && f.IsExported() {
+			return f.Type
+		}
+	}
+	return nil
+}
+
+// unknownKeys returns members of the JSON object data that t has no field for
+func unknownKeys(data []byte, t reflect.Type) extraFields {
+	var all map[string]json.RawMessage
+	if json.Unmarshal(data, &all) != nil {
+		return nil
+	}
+	known := jsonKeys(t)
+	var extra extraFields
+	for key, value := range all {
+		if known[key] {
+			continue
+		}
+		if extra == nil {
+			extra = extraFields{}
+		}
+		extra[key] = value
+	}
+	return extra
+}
+
+// memberKeys returns the keys of the JSON object data
+func memberKeys(data []byte) map[string]bool {
+	var all map[string]json.RawMessage
+	if json.Unmarshal(data, &all) != nil {
+		return nil
+	}
+	keys := map[string]bool{}
+	for key := range all {
+		keys[key] = true
+	}
+	return keys
+}
+
+// withExtra appends extra members to the marshaled object data
+func withExtra(data []byte, extra extraFields) ([]byte, error) {
+	if len(extra) == 0 {
+		return data, nil
+	}
+	keys := make([]string, 0, len(extra))
+	for key := range extra {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	var out bytes.Buffer
+	out.Write(bytes.TrimSuffix(data, []byte("}")))
+	for i, key := range keys {
+		if i > 0 || len(data) > 2 {
+			out.WriteByte(',')
+		}
+		name, _ := json.Marshal(key)
+		out.Write(name)
+		out.WriteByte(':')
+		out.Write(extra[key])
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
+func (c *Config) UnmarshalJSON(data []byte) error {
+	type plain Config
+	err := json.Unmarshal(data, (*plain)(c))
+	c.extra = unknownKeys(data, reflect.TypeOf(plain{}))
+	return err
+}
+
+func (c Config) MarshalJSON() ([]byte, error) {
+	type plain Config
+	data, err := json.Marshal(plain(c))
+	if err != nil {
+		return nil, err
+	}
+	return withExtra(data, c.extra)
+}
+
+func (g *GlobalConfig) UnmarshalJSON(data []byte) error {
+	type plain GlobalConfig
+	err := json.Unmarshal(data, (*plain)(g))
+	g.extra = unknownKeys(data, reflect.TypeOf(plain{}))
+	g.set = memberKeys(data)
+	return err
+}
+
+func (g GlobalConfig) MarshalJSON() ([]byte, error) {
+	type plain GlobalConfig
+	data, err := json.Marshal(plain(g))
+	if err != nil {
+		return nil, err
+	}
+	return withExtra(data, g.extra)
+}
+
+func (r *Rule) UnmarshalJSON(data []byte) error {
+	type plain Rule
+	err := json.Unmarshal(data, (*plain)(r))
+	r.extra = unknownKeys(data, reflect.TypeOf(plain{}))
+	return err
+}
+
+func (r Rule) MarshalJSON() ([]byte, error) {
+	type plain Rule
+	data, err := json.Marshal(plain(r))
+	if err != nil {
+		return nil, err
+	}
+	return withExtra(data, r.extra)
+}
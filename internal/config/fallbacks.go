@@ -0,0 +1,147 @@
+package config
+
+import (
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Fallback is a browser for links no rule takes. They are tried in order
+// until one starts, see Fallbacks.
+type Fallback struct {
+	App     string `json:"app,omitempty"`
+	Program string `json:"program,omitempty"`
+	// Arguments is an argument template, {URL} when empty. Args, when set,
+	// replaces it like in Rule.
+	Arguments string   `json:"arguments,omitempty"`
+	Args      []string `json:"args,omitempty"`
+	// SystemDefault is the default browser of Windows, or an installed
+	// browser when LinkRouter is the default
+	SystemDefault bool `json:"systemDefault,omitempty"`
+}
+
+// FallbackSystemDefault is the Key of the system default browser entry
+const FallbackSystemDefault = "systemDefault"
+
+// NewFallback returns the fallback of a program or app:NAME with an argument
+// template, as fallbackBrowserPath and fallbackBrowserArgs give it
+func NewFallback(program, arguments string) Fallback {
+	if app, ok := strings.CutPrefix(program, AppPrefix); ok {
+		return Fallback{App: app, Arguments: arguments}
+	}
+	return Fallback{Program: program, Arguments: arguments}
+}
+
+// Key identifies the entry between runs, see RecordFallbacks
+func (f *Fallback) Key() string {
+	switch {
+	case f.SystemDefault:
+		return FallbackSystemDefault
+	case f.App != "":
+		return AppPrefix + f.App
+	}
+	return f.Program
+}
+
+// Fallbacks returns the fallback browsers in config order, fallbackBrowserPath
+// first, then global.fallbacks
+func (c *Config) Fallbacks() []Fallback {
+	var chain []Fallback
+	if c.Global.FallbackBrowserPath != "" {
+		chain = append(chain, NewFallback(c.Global.FallbackBrowserPath, c.Global.FallbackBrowserArgs))
+	}
+	return append(chain, c.Global.Fallbacks...)
+}
+
+// FallbackRetry is how long a fallback browser that failed to start is tried
+// only after the others
+const FallbackRetry = 24 * time.Hour
+
+// FallbackOrder returns the fallback browsers in the order to try them: config
+// order, but the ones that failed within FallbackRetry last, so that a missing
+// browser isn't tried first for every link
+func (c *Config) FallbackOrder() []Fallback {
+	return orderFallbacks(c.Fallbacks(), LoadState().FailedFallbacks, time.Now())
+}
+
+func orderFallbacks(chain []Fallback, failed map[string]time.Time, now time.Time) []Fallback {
+	if len(failed) == 0 {
+		return chain
+	}
+	recent := func(f Fallback) bool {
+		at, ok := failed[f.Key()]
+		return ok && now.Sub(at) < FallbackRetry
+	}
+	chain = slices.Clone(chain)
+	slices.SortStableFunc(chain, func(a, b Fallback) int {
+		switch ra, rb := recent(a), recent(b); {
+		case ra == rb:
+			return 0
+		case ra:
+			return 1
+		}
+		return -1
+	})
+	return chain
+}
+
+// RecordFallbacks saves that the fallback browsers with keys failed to start
+// now and forgets a failure of started, "" when none did
+func RecordFallbacks(failed []string, started string) error {
+	state := LoadState()
+	_, changed := state.FailedFallbacks[started]
+	delete(state.FailedFallbacks, started)
+	if len(failed) > 0 && state.FailedFallbacks == nil {
+		state.FailedFallbacks = map[string]time.Time{}
+	}
+	for _, key := range failed {
+		state.FailedFallbacks[key] = time.Now()
+		changed = true
+	}
+	if !changed {
+		return nil
+	}
+	return state.Save()
+}
+
+// ResetFallbacks forgets the failures of all fallback browsers, so they are
+// tried in config order again
+func ResetFallbacks() error {
+	state := LoadState()
+	if state.FailedFallbacks == nil {
+		return nil
+	}
+	state.FailedFallbacks = nil
+	return state.Save()
+}
+
+// FallbackLaunch resolves what fallback f launches. Empty arguments stand
+// for {URL}. The system default browser is looked up once, see
+// SystemBrowserPath.
+func (c *Config) FallbackLaunch(f *Fallback) (*Launch, error) {
+	arguments := f.Arguments
+	if len(f.Args) > 0 {
+		arguments = ""
+	} else if arguments == "" {
+		arguments = "{URL}"
+	}
+	program := f.Program
+	if f.SystemDefault {
+		if program = SystemBrowserPath(); program == "" {
+			return nil, errors.New("no system default browser found")
+		}
+	}
+	g := &c.Global
+	return c.newLaunch(f.App, program, arguments, f.Args, g.FallbackWorkingDir, g.FallbackEnv)
+}
+
+var systemBrowser = sync.OnceValue(func() string { return findDefaultBrowser(false) })
+
+// SystemBrowserPath is the default browser of Windows, never LinkRouter
+// itself: when LinkRouter is the default, the first installed browser of
+// a list of known ones. Empty when there is none.
+func SystemBrowserPath() string {
+	return systemBrowser()
+}
@@ -0,0 +1,72 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func fallbackKeys(chain []Fallback) []string {
+	var keys []string
+	for _, f := range chain {
+		keys = append(keys, f.Key())
+	}
+	return keys
+}
+
+func TestOrderFallbacks(t *testing.T) {
+	chain := []Fallback{{Program: "a.exe"}, {App: "b"}, {Program: "c.exe"}, {SystemDefault: true}}
+	now := time.Date(2026, 1, 2, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failed map[string]time.Time
+		want   []string
+	}{
+		{nil, []string{"a.exe", "app:b", "c.exe", "systemDefault"}},
+		{map[string]time.Time{"a.exe": now.Add(-time.Hour)}, []string{"app:b", "c.exe", "systemDefault", "a.exe"}},
+		{map[string]time.Time{"a.exe": now.Add(-time.Hour), "c.exe": now}, []string{"app:b", "systemDefault", "a.exe", "c.exe"}},
+		{map[string]time.Time{"a.exe": now.Add(-FallbackRetry)}, []string{"a.exe", "app:b", "c.exe", "systemDefault"}},
+		{map[string]time.Time{"gone.exe": now}, []string{"a.exe", "app:b", "c.exe", "systemDefault"}},
+	}
+	for _, tt := range tests {
+		got := fallbackKeys(orderFallbacks(chain, tt.failed, now))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("orderFallbacks with %v = %v, want %v", tt.failed, got, tt.want)
+		}
+	}
+	if got := fallbackKeys(chain); got[0] != "a.exe" {
+		t.Errorf("orderFallbacks changed the chain passed in: %v", got)
+	}
+}
+
+func TestRecordFallbacks(t *testing.T) {
+	t.Setenv("LOCALAPPDATA", t.TempDir())
+	cfg := &Config{Global: GlobalConfig{FallbackBrowserPath: "a.exe", Fallbacks: []Fallback{{Program: "b.exe"}, {Program: "c.exe"}}}}
+
+	if err := RecordFallbacks([]string{"a.exe"}, "b.exe"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fallbackKeys(cfg.FallbackOrder()); !reflect.DeepEqual(got, []string{"b.exe", "c.exe", "a.exe"}) {
+		t.Errorf("after a.exe failed, order = %v", got)
+	}
+
+	// a browser that starts again gets its place back
+	if err := RecordFallbacks(nil, "a.exe"); err != nil {
+		t.Fatal(err)
+	}
+	if got := fallbackKeys(cfg.FallbackOrder()); !reflect.DeepEqual(got, []string{"a.exe", "b.exe", "c.exe"}) {
+		t.Errorf("after a.exe started, order = %v", got)
+	}
+
+	if err := RecordFallbacks([]string{"a.exe", "b.exe", "c.exe"}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if got := fallbackKeys(cfg.FallbackOrder()); !reflect.DeepEqual(got, []string{"a.exe", "b.exe", "c.exe"}) {
+		t.Errorf("after all failed, order = %v", got)
+	}
+	if err := ResetFallbacks(); err != nil {
+		t.Fatal(err)
+	}
+	if state := LoadState(); state.FailedFallbacks != nil {
+		t.Errorf("after ResetFallbacks, failed = %v", state.FailedFallbacks)
+	}
+}
@@ -0,0 +1,166 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"linkrouter/internal/logger"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// config file names, in the order they are looked for in a directory
+var configNames = []string{"linkrouter.json", "linkrouter.yaml", "linkrouter.yml", "linkrouter.toml"}
+
+// configFormat converts one config file syntax to and from JSON,
+// which is what the rest of the package works with
+type configFormat struct {
+	name string
+	// toJSON converts a file. locate, when set, maps the JSON path of a
+	// problem back to a line and column of the file.
+	toJSON func(data []byte) (doc []byte, locate func(path string) (int, int), err error)
+	// fromJSON renders doc. original is the file being overwritten, or nil.
+	// Formats that can keep its comments and layout do so.
+	fromJSON func(doc, original []byte) ([]byte, error)
+}
+
+var jsonFormat = &configFormat{
+	name: "JSON",
+	toJSON: func(data []byte) ([]byte, func(string) (int, int), error) {
+		// comments and trailing commas are allowed, line and column stay the same
+		stripped, err := stripJSONC(data)
+		return stripped, nil, err
+	},
+	fromJSON: func(doc, original []byte) ([]byte, error) {
+		if original != nil {
+			patched, err := patchJSONC(original, doc)
+			if err == nil {
+				return patched, nil
+			}
+			logger.Log(fmt.Sprintf("Can't keep formatting of the config, rewriting it: %s", err))
+		}
+		var out bytes.Buffer
+		if err := json.Indent(&out, doc, "", "  "); err != nil {
+			return nil, err
+		}
+		return out.Bytes(), nil
+	},
+}
+
+// formatOf picks the format by file extension, JSON by default
+func formatOf(path string) *configFormat {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return yamlFormat
+	case ".toml":
+		return tomlFormat
+	}
+	return jsonFormat
+}
+
+// ConvertConfig rewrites the config at in into the format of out, which must
+// not exist yet. The whole document is converted, including keys LinkRouter
+// doesn't know; comments are not carried over.
+func ConvertConfig(in, out string) error {
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists", out)
+	}
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	doc, _, err := formatOf(in).toJSON(data)
+	if err != nil {
+		return fmt.Errorf("can't parse %s: %w", in, err)
+	}
+	if _, err := parseJSON(doc); err != nil {
+		return fmt.Errorf("can't parse %s: %w", in, err)
+	}
+	converted, err := formatOf(out).fromJSON(doc, nil)
+	if err != nil {
+		return fmt.Errorf("can't convert to %s: %w", formatOf(out).name, err)
+	}
+	return os.WriteFile(out, converted, 0600)
+}
+
+// rewriteDoc applies edit to the document of the config file at path and
+// renders it back in the file's format. Key order is kept, and so are the
+// comments and layout where the format allows.
+func rewriteDoc(path string, edit func(doc map[string]any) error) (original, updated []byte, err error) {
+	original, err = os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	format := formatOf(path)
+	data, _, err := format.toJSON(original)
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	var doc map[string]any
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, nil, fmt.Errorf("can't parse %s: %w", path, err)
+	}
+	if err := edit(doc); err != nil {
+		return nil, nil, err
+	}
+	edited, err := json.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if edited, err = omitAddedZeros(edited, data, false); err != nil {
+		return nil, nil, err
+	}
+	// doc is a map, patching puts keys back in the original order
+	if data, err = patchJSONC(data, edited); err != nil {
+		return nil, nil, err
+	}
+	updated, err = format.fromJSON(data, original)
+	if err != nil {
+		return nil, nil, err
+	}
+	return original, updated, nil
+}
+
+// locateJSON returns the position of the value at path in a JSON document,
+// or of the deepest one found on the way
+func locateJSON(data []byte, tree *jsonNode, path string) (int, int) {
+	n := tree
+	for _, seg := range splitPath(path) {
+		var next *jsonNode
+		switch seg := seg.(type) {
+		case string:
+			next = n.field(seg)
+		case int:
+			next = n.item(seg)
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return position(data, n.offset)
+}
+
+// splitPath splits a problem path such as rules[3].exclude[1].host into
+// object keys (string) and array indexes (int)
+func splitPath(path string) []any {
+	var segments []any
+	for _, part := range strings.Split(path, ".") {
+		key, rest, _ := strings.Cut(part, "[")
+		if key != "" {
+			segments = append(segments, key)
+		}
+		for rest != "" {
+			index, after, _ := strings.Cut(rest, "]")
+			if i, err := strconv.Atoi(index); err == nil {
+				segments = append(segments, i)
+			}
+			_, rest, _ = strings.Cut(after, "[")
+		}
+	}
+	return segments
+}
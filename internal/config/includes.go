@@ -0,0 +1,186 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// includeDir holds rule files that are included without being listed
+const includeDir = "linkrouter.d"
+
+// IncludeFile is a file whose rules were merged into the config, see
+// global.include. Its rules have Rule.File set to Path.
+type IncludeFile struct {
+	Path string `json:"path"`
+	// Priority orders files, higher first. The config itself has 0 and comes
+	// before included files of the same priority.
+	Priority int `json:"priority,omitempty"`
+	// ReadOnly is set by the file, or when it can't be written
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// Layer is set when the file is the config of another layer
+	Layer string `json:"layer,omitempty"`
+}
+
+// includePaths resolves global.include, relative to the config, followed by
+// the files of linkrouter.d next to it. Globs and the directory are expanded in
+// name order and a file found twice is included once. Entries naming a file
+// that can't be found are passed to report.
+func includePaths(configPath string, patterns []string, report func(i int, err error)) []string {
+	dir := filepath.Dir(configPath)
+	seen := map[string]bool{strings.ToLower(filepath.Clean(configPath)): true}
+	var paths []string
+	add := func(path string) {
+		key := strings.ToLower(filepath.Clean(path))
+		if !seen[key] {
+			seen[key] = true
+			paths = append(paths, path)
+		}
+	}
+
+	for i, pattern := range patterns {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(dir, pattern)
+		}
+		if strings.ContainsAny(pattern, "*?[") {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				report(i, err)
+			}
+			for _, match := range matches {
+				if info, err := os.Stat(match); err == nil && !info.IsDir() {
+					add(match)
+				}
+			}
+			continue
+		}
+		if _, err := os.Stat(pattern); err != nil {
+			report(i, err)
+			continue
+		}
+		add(pattern)
+	}
+
+	entries, _ := os.ReadDir(filepath.Join(dir, includeDir))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && slices.Contains([]string{".json", ".yaml", ".yml", ".toml"}, strings.ToLower(filepath.Ext(name))) {
+			add(filepath.Join(dir, includeDir, name))
+		}
+	}
+	return paths
+}
+
+// readIncludes adds the rules of included files to the config, ordered by
+// file priority. locate positions problems of the config itself.
+func (c *Config) readIncludes(configPath string, locate func(path string) (int, int)) {
+	type source struct {
+		file     IncludeFile
+		rules    []Rule
+		problems []Problem
+	}
+	// both are only set here, whatever the file says
+	c.Includes = nil
+	for i := range c.Rules {
+		c.Rules[i].File = ""
+	}
+	sources := []source{{rules: c.Rules, problems: c.Problems}}
+	var failed []Problem
+
+	paths := includePaths(configPath, c.Global.Include, func(i int, err error) {
+		p := Problem{Path: fmt.Sprintf("global.include[%d]", i), Rule: -1, Severity: SeverityError, Message: err.Error()}
+		p.Line, p.Column = locate(p.Path)
+		failed = append(failed, p)
+	})
+	for _, path := range paths {
+		inc, _, err := readConfigFile(path, true)
+		if err != nil {
+			failed = append(failed, Problem{File: path, Rule: -1, Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		f := IncludeFile{Path: path}
+		// not part of Config, so they are among the unknown keys
+		json.Unmarshal(inc.extra["priority"], &f.Priority)
+		json.Unmarshal(inc.extra["readOnly"], &f.ReadOnly)
+		f.ReadOnly = f.ReadOnly || !fileWritable(path)
+		for i := range inc.Rules {
+			inc.Rules[i].File = path
+		}
+		c.Includes = append(c.Includes, f)
+		sources = append(sources, source{f, inc.Rules, inc.Problems})
+	}
+
+	slices.SortStableFunc(sources, func(a, b source) int {
+		return b.file.Priority - a.file.Priority
+	})
+	c.Rules, c.Problems = nil, nil
+	for _, s := range sources {
+		offset := len(c.Rules)
+		for _, p := range s.problems {
+			if p.Rule >= 0 {
+				p.Rule += offset
+			}
+			c.Problems = append(c.Problems, p)
+		}
+		c.Rules = append(c.Rules, s.rules...)
+	}
+	c.Problems = append(c.Problems, failed...)
+}
+
+// saveIncludes writes rules back to the writable files they came from and
+// returns the rest, which belong to the config itself. Rules of read-only
+// files are dropped, the files keep them.
+func (c *Config) saveIncludes() ([]Rule, error) {
+	files := map[string]*IncludeFile{}
+	for i := range c.Includes {
+		files[c.Includes[i].Path] = &c.Includes[i]
+	}
+	owned := map[string][]Rule{}
+	own := []Rule{}
+	for _, rule := range c.Rules {
+		f := files[rule.File]
+		rule.File = ""
+		switch {
+		case f == nil:
+			own = append(own, rule)
+		case !f.ReadOnly:
+			owned[f.Path] = append(owned[f.Path], rule)
+		}
+	}
+	for _, f := range c.Includes {
+		if f.ReadOnly {
+			continue
+		}
+		rules := owned[f.Path]
+		if rules == nil {
+			rules = []Rule{}
+		}
+		original, updated, err := rewriteDoc(f.Path, func(doc map[string]any) error {
+			doc["rules"] = rules
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if string(updated) == string(original) {
+			continue
+		}
+		if err := os.WriteFile(f.Path, updated, 0600); err != nil {
+			return nil, err
+		}
+	}
+	return own, nil
+}
+
+// fileWritable tells whether path can be opened for writing, without changing it
+func fileWritable(path string) bool {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return false
+	}
+	f.Close()
+	return true
+}
@@ -0,0 +1,411 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// stripJSONC turns JSON with comments and trailing commas into plain JSON of
+// the same length. Comments and trailing commas become spaces, so offsets and
+// line numbers still point into the original text.
+func stripJSONC(data []byte) ([]byte, error) {
+	out := bytes.Clone(data)
+	// a UTF-8 BOM, as written by Notepad
+	if bytes.HasPrefix(out, []byte("\xef\xbb\xbf")) {
+		copy(out, "   ")
+	}
+	blank := func(from, to int) {
+		for i := from; i < to; i++ {
+			if out[i] != '\n' && out[i] != '\r' {
+				out[i] = ' '
+			}
+		}
+	}
+	pendingComma := -1
+	for i := 0; i < len(out); i++ {
+		c := out[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			continue
+		case c == '"':
+			for i++; i < len(out) && out[i] != '"'; i++ {
+				if out[i] == '\\' {
+					i++
+				}
+			}
+		case c == '/' && i+1 < len(out) && out[i+1] == '/':
+			end := bytes.IndexByte(out[i:], '\n')
+			if end < 0 {
+				end = len(out) - i
+			}
+			blank(i, i+end)
+			i += end - 1
+			continue
+		case c == '/' && i+1 < len(out) && out[i+1] == '*':
+			end := bytes.Index(out[i+2:], []byte("*/"))
+			if end < 0 {
+				line, col := position(data, i)
+				return nil, &SyntaxError{Line: line, Column: col, Msg: "unterminated comment"}
+			}
+			blank(i, i+2+end+2)
+			i += 2 + end + 1
+			continue
+		case (c == '}' || c == ']') && pendingComma >= 0:
+			out[pendingComma] = ' '
+		}
+		pendingComma = -1
+		if c == ',' {
+			pendingComma = i
+		}
+	}
+	return out, nil
+}
+
+// patchJSONC rewrites the original config text so it holds the values of
+// updated, a freshly marshaled config. Unchanged values are kept verbatim,
+// with their comments and formatting, changed ones are replaced in place,
+// keys keep their order and array elements keep the comments around them.
+func patchJSONC(original, updated []byte) ([]byte, error) {
+	stripped, err := stripJSONC(original)
+	if err != nil {
+		return nil, err
+	}
+	oldRoot, err := parseJSON(stripped)
+	if err != nil {
+		return nil, err
+	}
+	newRoot, err := parseJSON(updated)
+	if err != nil {
+		return nil, err
+	}
+	p := &patcher{old: original, stripped: stripped, new: updated}
+	var out bytes.Buffer
+	out.Write(original[:oldRoot.offset])
+	out.WriteString(p.rewrite(oldRoot, newRoot, lineIndent(original, oldRoot.offset), false))
+	out.Write(original[oldRoot.end:])
+	return out.Bytes(), nil
+}
+
+type patcher struct {
+	old, stripped, new []byte
+}
+
+// element is one member of an object or array in the original text: lead is
+// everything from the previous separator up to the value (comments, key),
+// trail is what follows the value up to the next comma
+type element struct {
+	lead, trail string
+}
+
+func canonical(data []byte, n *jsonNode) string {
+	var v any
+	if err := json.Unmarshal(data[n.offset:n.end], &v); err != nil {
+		return ""
+	}
+	out, _ := json.Marshal(v)
+	return string(out)
+}
+
+// fresh renders a new value indented to fit at indent
+func (p *patcher) fresh(n *jsonNode, indent string, inline bool) string {
+	var buf bytes.Buffer
+	src := p.new[n.offset:n.end]
+	if inline {
+		json.Compact(&buf, src)
+	} else {
+		json.Indent(&buf, src, indent, "  ")
+	}
+	return buf.String()
+}
+
+// rewrite returns the text of n, reusing o where possible. inline tells
+// whether the parent of o is written on a single line.
+func (p *patcher) rewrite(o, n *jsonNode, indent string, inline bool) string {
+	if canonical(p.stripped, o) == canonical(p.new, n) {
+		return string(p.old[o.offset:o.end])
+	}
+	if o.kind != n.kind || (o.kind != "object" && o.kind != "array") {
+		return p.fresh(n, indent, inline)
+	}
+
+	elements, closing := p.elements(o)
+	if len(elements) > 0 {
+		inline = !strings.Contains(elements[len(elements)-1].lead, "\n")
+	}
+	childIndent := indent + "  "
+	if len(elements) > 0 && !inline {
+		childIndent = valueIndent(elements[len(elements)-1].lead)
+	}
+	newLead := "\n" + childIndent
+	if inline {
+		newLead = " "
+	}
+
+	var out []string
+	if o.kind == "object" {
+		newFields := map[string]*jsonNode{}
+		for _, f := range n.fields {
+			newFields[f.key] = f.value
+		}
+		done := map[string]bool{}
+		for k, f := range o.fields {
+			value, ok := newFields[f.key]
+			if !ok || done[f.key] {
+				continue
+			}
+			done[f.key] = true
+			out = append(out, elements[k].lead+p.rewrite(f.value, value, childIndent, inline)+elements[k].trail)
+		}
+		for _, f := range n.fields {
+			if done[f.key] {
+				continue
+			}
+			done[f.key] = true
+			key, _ := json.Marshal(f.key)
+			out = append(out, newLead+string(key)+": "+p.fresh(f.value, childIndent, inline))
+		}
+	} else {
+		for j, k := range p.matchItems(o, n) {
+			if k < 0 {
+				out = append(out, newLead+p.fresh(n.items[j], childIndent, inline))
+				continue
+			}
+			out = append(out, elements[k].lead+p.rewrite(o.items[k], n.items[j], childIndent, inline)+elements[k].trail)
+		}
+	}
+
+	if inline {
+		for i := range out {
+			out[i] = strings.TrimLeft(out[i], " \t")
+			if i > 0 {
+				out[i] = " " + out[i]
+			}
+		}
+	}
+	switch {
+	case len(out) == 0:
+		closing = strings.Replace(closing, ",", "", 1)
+		if strings.TrimSpace(closing) == "" {
+			closing = ""
+		}
+	case len(elements) == 0 && !inline:
+		closing = strings.TrimRight(closing, " \t\r\n") + "\n" + indent
+	}
+	openBracket, closeBracket := "{", "}"
+	if o.kind == "array" {
+		openBracket, closeBracket = "[", "]"
+	}
+	return openBracket + strings.Join(out, ",") + closing + closeBracket
+}
+
+// elements splits a container of the original text into its members.
+// The text after the last value, up to the closing bracket, is returned
+// separately since it stays at the end whatever happens to the members.
+func (p *patcher) elements(o *jsonNode) ([]element, string) {
+	var values []*jsonNode
+	if o.kind == "object" {
+		for _, f := range o.fields {
+			values = append(values, f.value)
+		}
+	} else {
+		values = o.items
+	}
+	var elements []element
+	start := o.offset + 1
+	for k, v := range values {
+		end := o.end - 1
+		if k < len(o.commas) {
+			end = o.commas[k]
+		}
+		elements = append(elements, element{
+			lead:  string(p.old[start:v.offset]),
+			trail: string(p.old[v.end:end]),
+		})
+		start = end + 1
+	}
+	if len(elements) == 0 {
+		return nil, string(p.old[o.offset+1 : o.end-1])
+	}
+	closing := elements[len(elements)-1].trail
+	elements[len(elements)-1].trail = ""
+	return elements, closing
+}
+
+// matchItems pairs every new array item with an old one, see pairItems
+func (p *patcher) matchItems(o, n *jsonNode) []int {
+	var oldCanon, newCanon, oldKinds, newKinds []string
+	for _, item := range o.items {
+		oldCanon = append(oldCanon, canonical(p.stripped, item))
+		oldKinds = append(oldKinds, item.kind)
+	}
+	for _, item := range n.items {
+		newCanon = append(newCanon, canonical(p.new, item))
+		newKinds = append(newKinds, item.kind)
+	}
+	return pairItems(oldCanon, newCanon, oldKinds, newKinds)
+}
+
+// pairItems matches new array items to old ones, so comments stay with their
+// items: an identical item first, which handles reordering, then the item at
+// the same position, then any leftover item of the same kind, which handles
+// an item that was moved and edited. -1 means a new item.
+func pairItems(oldCanon, newCanon, oldKinds, newKinds []string) []int {
+	used := make([]bool, len(oldCanon))
+	match := make([]int, len(newCanon))
+	for j, c := range newCanon {
+		match[j] = -1
+		if j < len(oldCanon) && !used[j] && oldCanon[j] == c {
+			match[j], used[j] = j, true
+			continue
+		}
+		for k := range oldCanon {
+			if !used[k] && oldCanon[k] == c {
+				match[j], used[k] = k, true
+				break
+			}
+		}
+	}
+	for j := range newCanon {
+		if match[j] < 0 && j < len(oldCanon) && !used[j] && oldKinds[j] == newKinds[j] {
+			match[j], used[j] = j, true
+		}
+	}
+	for j := range newCanon {
+		for k := 0; match[j] < 0 && k < len(oldCanon); k++ {
+			if !used[k] && oldKinds[k] == newKinds[j] {
+				match[j], used[k] = k, true
+			}
+		}
+	}
+	return match
+}
+
+// valueIndent returns the indentation of the line a value starts on
+func valueIndent(lead string) string {
+	line := lead[strings.LastIndex(lead, "\n")+1:]
+	return line[:len(line)-len(strings.TrimLeft(line, " \t"))]
+}
+
+// lineIndent returns the indentation of the line containing offset
+func lineIndent(data []byte, offset int) string {
+	start := bytes.LastIndexByte(data[:offset], '\n') + 1
+	return valueIndent(string(data[start:offset]))
+}
+
+// omitAddedZeros drops the members of doc, a marshaled config, that original
+// doesn't have and that hold the zero value of their field, such as
+// "arguments": "" of a rule that had none, so that a save doesn't add keys
+// the file never set. Only struct fields are dropped; keys of maps like
+// variables or env are data. With keepGlobal the members of global stay,
+// for when the other config layers decided them, see dropInherited.
+func omitAddedZeros(doc, original []byte, keepGlobal bool) ([]byte, error) {
+	n, err := parseJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	o, err := parseJSON(original)
+	if err != nil {
+		return doc, nil
+	}
+	z := &zeroOmitter{patcher: patcher{stripped: original, new: doc}, keepGlobal: keepGlobal}
+	var out bytes.Buffer
+	z.write(&out, n, o, reflect.TypeOf(Config{}), false)
+	return out.Bytes(), nil
+}
+
+type zeroOmitter struct {
+	patcher
+	keepGlobal bool
+}
+
+// write writes n of type t compactly, o is its counterpart in the original or
+// nil. keep keeps the members of n even when they are zero.
+func (z *zeroOmitter) write(out *bytes.Buffer, n, o *jsonNode, t reflect.Type, keep bool) {
+	for t != nil && t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch n.kind {
+	case "object":
+		out.WriteByte('{')
+		first := true
+		for _, f := range n.fields {
+			var ft reflect.Type
+			switch {
+			case t != nil && t.Kind() == reflect.Struct:
+				ft = jsonFieldType(t, f.key)
+				if ft != nil && !keep && o.member(f.key) == nil && isZeroJSON(z.new, f.value) {
+					continue
+				}
+			case t != nil && t.Kind() == reflect.Map:
+				ft = t.Elem()
+			}
+			if !first {
+				out.WriteByte(',')
+			}
+			first = false
+			key, _ := json.Marshal(f.key)
+			out.Write(key)
+			out.WriteByte(':')
+			keepMembers := z.keepGlobal && t == reflect.TypeOf(Config{}) && f.key == "global"
+			z.write(out, f.value, o.member(f.key), ft, keepMembers)
+		}
+		out.WriteByte('}')
+	case "array":
+		var et reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			et = t.Elem()
+		}
+		var match []int
+		if o != nil && o.kind == "array" {
+			match = z.matchItems(o, n)
+		}
+		out.WriteByte('[')
+		for j, item := range n.items {
+			if j > 0 {
+				out.WriteByte(',')
+			}
+			var old *jsonNode
+			if match != nil && match[j] >= 0 {
+				old = o.items[match[j]]
+			}
+			z.write(out, item, old, et, false)
+		}
+		out.WriteByte(']')
+	default:
+		out.Write(z.new[n.offset:n.end])
+	}
+}
+
+// member returns the value of key when n is an object that has it
+func (n *jsonNode) member(key string) *jsonNode {
+	if n == nil || n.kind != "object" {
+		return nil
+	}
+	for _, f := range n.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// isZeroJSON tells if n is null, "", 0, false or an empty array or object
+func isZeroJSON(data []byte, n *jsonNode) bool {
+	switch n.kind {
+	case "object":
+		return len(n.fields) == 0
+	case "array":
+		return len(n.items) == 0
+	case "number":
+		f, err := strconv.ParseFloat(string(data[n.offset:n.end]), 64)
+		return err == nil && f == 0
+	}
+	switch string(data[n.offset:n.end]) {
+	case "null", `""`, "false":
+		return true
+	}
+	return false
+}
@@ -0,0 +1,91 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSaveDoesNotAddEmptyKeys(t *testing.T) {
+	const original = `{
+  // only what the user set
+  "global": {
+    "fallbackBrowserPath": "firefox.exe"
+  },
+  "rules": [
+    { "regex": "^https://a/", "program": "a.exe" }
+  ]
+}
+`
+	path := filepath.Join(t.TempDir(), "linkrouter.json")
+	if err := os.WriteFile(path, []byte(original), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := decodeConfig([]byte(`{
+		"global": {"fallbackBrowserPath": "firefox.exe"},
+		"rules": [{"regex": "^https://a/", "program": "a.exe"}]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := cfg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != original {
+		t.Errorf("unchanged config was rewritten:\n%s", data)
+	}
+
+	cfg.Global.LogPath = "linkrouter.log"
+	cfg.Rules[0].Arguments = "$0"
+	cfg.Rules = append(cfg.Rules, Rule{URLMatcher: URLMatcher{Host: "b"}, Program: "b.exe"})
+	cfg.Variables = map[string]string{"empty": ""}
+	if err := cfg.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(path)
+	for _, want := range []string{`"logPath": "linkrouter.log"`, `"arguments": "$0"`, `"host": "b"`, `"empty": ""`, "// only what the user set"} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("saved config lacks %s:\n%s", want, data)
+		}
+	}
+	for _, unwanted := range []string{"defaultConfigEditor", "interactiveMode", "supportedProtocols", `"regex": ""`} {
+		if strings.Contains(string(data), unwanted) {
+			t.Errorf("saved config has %s added:\n%s", unwanted, data)
+		}
+	}
+}
+
+func TestOmitAddedZeros(t *testing.T) {
+	tests := []struct {
+		doc, original, want string
+		keepGlobal          bool
+	}{
+		// zero fields the original lacks go, the ones it has stay
+		{`{"global":{"logPath":"","interactiveMode":false},"rules":[]}`, `{"global":{"logPath":""}}`,
+			`{"global":{"logPath":""}}`, false},
+		{`{"global":{"logPath":"x","interactiveMode":true}}`, `{}`,
+			`{"global":{"logPath":"x","interactiveMode":true}}`, false},
+		// the layers decided global
+		{`{"global":{"logPath":""}}`, `{"global":{}}`, `{"global":{"logPath":""}}`, true},
+		// map values and unknown keys are data
+		{`{"variables":{"a":""},"annotation":""}`, `{}`, `{"variables":{"a":""},"annotation":""}`, false},
+		{`{"rules":[{"regex":"","program":"a","env":{"X":""}}]}`, `{}`, `{"rules":[{"program":"a","env":{"X":""}}]}`, false},
+		// array items are paired with the original ones
+		{`{"rules":[{"regex":"b","arguments":""},{"regex":"a","arguments":""}]}`, `{"rules":[{"regex":"a","arguments":""}]}`,
+			`{"rules":[{"regex":"b"},{"regex":"a","arguments":""}]}`, false},
+		{`{"profiles":{"work":{"global":{"interactiveMode":false},"rules":[]}}}`, `{"profiles":{"work":{"global":{}}}}`,
+			`{"profiles":{"work":{"global":{"interactiveMode":false}}}}`, false},
+	}
+	for _, tt := range tests {
+		got, err := omitAddedZeros([]byte(tt.doc), []byte(tt.original), tt.keepGlobal)
+		if err != nil {
+			t.Errorf("omitAddedZeros(%s, %s): %v", tt.doc, tt.original, err)
+			continue
+		}
+		if string(got) != tt.want {
+			t.Errorf("omitAddedZeros(%s, %s) = %s, want %s", tt.doc, tt.original, got, tt.want)
+		}
+	}
+}
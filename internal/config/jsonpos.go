@@ -0,0 +1,257 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// jsonNode is a parsed JSON value that remembers where it came from,
+// so problems can be reported with line and column
+type jsonNode struct {
+	kind   string // object, array, string, number, boolean, null
+	offset int
+	end    int
+	fields []jsonField
+	items  []*jsonNode
+	// positions of the commas between elements of objects and arrays
+	commas []int
+	// raw source of scalars
+	raw string
+}
+
+type jsonField struct {
+	key    string
+	offset int
+	value  *jsonNode
+}
+
+type jsonParser struct {
+	data []byte
+	pos  int
+}
+
+// SyntaxError is a JSON syntax error with its position
+type SyntaxError struct {
+	Line, Column int
+	Msg          string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("line %d, column %d: %s", e.Line, e.Column, e.Msg)
+}
+
+func parseJSON(data []byte) (*jsonNode, error) {
+	p := &jsonParser{data: data}
+	p.skipSpace()
+	node, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.data) {
+		return nil, p.errorf("unexpected %q after top-level value", p.data[p.pos])
+	}
+	return node, nil
+}
+
+func (p *jsonParser) errorf(format string, args ...any) error {
+	line, col := position(p.data, p.pos)
+	return &SyntaxError{Line: line, Column: col, Msg: fmt.Sprintf(format, args...)}
+}
+
+// position converts a byte offset to 1-based line and column
+func position(data []byte, offset int) (int, int) {
+	line, col := 1, 1
+	for i := 0; i < offset && i < len(data); i++ {
+		if data[i] == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+func (p *jsonParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\r', '\n':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) value() (*jsonNode, error) {
+	if p.pos >= len(p.data) {
+		return nil, p.errorf("unexpected end of input")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '{':
+		return p.object()
+	case c == '[':
+		return p.array()
+	case c == '"':
+		start := p.pos
+		if _, err := p.str(); err != nil {
+			return nil, err
+		}
+		return &jsonNode{kind: "string", offset: start, end: p.pos, raw: string(p.data[start:p.pos])}, nil
+	case c == '-' || (c >= '0' && c <= '9'):
+		start := p.pos
+		for p.pos < len(p.data) && strings.IndexByte("+-.eE0123456789", p.data[p.pos]) >= 0 {
+			p.pos++
+		}
+		raw := string(p.data[start:p.pos])
+		if _, err := strconv.ParseFloat(raw, 64); err != nil {
+			p.pos = start
+			return nil, p.errorf("invalid number %q", raw)
+		}
+		return &jsonNode{kind: "number", offset: start, end: p.pos, raw: raw}, nil
+	default:
+		for _, lit := range []string{"true", "false", "null"} {
+			if strings.HasPrefix(string(p.data[p.pos:min(p.pos+5, len(p.data))]), lit) {
+				node := &jsonNode{kind: "boolean", offset: p.pos, raw: lit}
+				if lit == "null" {
+					node.kind = "null"
+				}
+				p.pos += len(lit)
+				node.end = p.pos
+				return node, nil
+			}
+		}
+		return nil, p.errorf("unexpected %q", c)
+	}
+}
+
+func (p *jsonParser) str() (string, error) {
+	start := p.pos
+	p.pos++
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case '\\':
+			p.pos += 2
+		case '"':
+			p.pos++
+			var s string
+			if err := json.Unmarshal(p.data[start:p.pos], &s); err != nil {
+				p.pos = start
+				return "", p.errorf("invalid string: %s", err)
+			}
+			return s, nil
+		case '\n':
+			return "", p.errorf("newline in string")
+		default:
+			p.pos++
+		}
+	}
+	p.pos = start
+	return "", p.errorf("unterminated string")
+}
+
+func (p *jsonParser) object() (*jsonNode, error) {
+	node := &jsonNode{kind: "object", offset: p.pos}
+	p.pos++
+	p.skipSpace()
+	if p.pos < len(p.data) && p.data[p.pos] == '}' {
+		p.pos++
+		node.end = p.pos
+		return node, nil
+	}
+	for {
+		p.skipSpace()
+		if p.pos >= len(p.data) || p.data[p.pos] != '"' {
+			return nil, p.errorf("expected object key")
+		}
+		keyOffset := p.pos
+		key, err := p.str()
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos >= len(p.data) || p.data[p.pos] != ':' {
+			return nil, p.errorf("expected ':' after object key")
+		}
+		p.pos++
+		p.skipSpace()
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		node.fields = append(node.fields, jsonField{key: key, offset: keyOffset, value: value})
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unterminated object")
+		}
+		switch p.data[p.pos] {
+		case ',':
+			node.commas = append(node.commas, p.pos)
+			p.pos++
+		case '}':
+			p.pos++
+			node.end = p.pos
+			return node, nil
+		default:
+			return nil, p.errorf("expected ',' or '}' in object")
+		}
+	}
+}
+
+func (p *jsonParser) array() (*jsonNode, error) {
+	node := &jsonNode{kind: "array", offset: p.pos}
+	p.pos++
+	p.skipSpace()
+	if p.pos < len(p.data) && p.data[p.pos] == ']' {
+		p.pos++
+		node.end = p.pos
+		return node, nil
+	}
+	for {
+		p.skipSpace()
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		node.items = append(node.items, value)
+		p.skipSpace()
+		if p.pos >= len(p.data) {
+			return nil, p.errorf("unterminated array")
+		}
+		switch p.data[p.pos] {
+		case ',':
+			node.commas = append(node.commas, p.pos)
+			p.pos++
+		case ']':
+			p.pos++
+			node.end = p.pos
+			return node, nil
+		default:
+			return nil, p.errorf("expected ',' or ']' in array")
+		}
+	}
+}
+
+// field returns the value of key in an object, or nil
+func (n *jsonNode) field(key string) *jsonNode {
+	if n == nil {
+		return nil
+	}
+	for _, f := range n.fields {
+		if f.key == key {
+			return f.value
+		}
+	}
+	return nil
+}
+
+// item returns the i-th element of an array, or nil
+func (n *jsonNode) item(i int) *jsonNode {
+	if n == nil || i < 0 || i >= len(n.items) {
+		return nil
+	}
+	return n.items[i]
+}
@@ -0,0 +1,363 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+)
+
+// Layer names, in the order layers are merged
+const (
+	LayerMachine  = "machine"
+	LayerPortable = "portable"
+	LayerUser     = "user"
+)
+
+// Layer is one of the config files merged into the effective config
+type Layer struct {
+	Name string `json:"name"`
+	Path string `json:"path"`
+}
+
+// Provenance tells where the effective value of a global setting comes from.
+// File is empty when no layer sets it.
+type Provenance struct {
+	Layer string `json:"layer,omitempty"`
+	File  string `json:"file,omitempty"`
+	// LockedBy is the file that locked the setting, later layers can't change it
+	LockedBy string `json:"lockedBy,omitempty"`
+}
+
+// configLayers returns the configs found for the machine, next to the
+// executable and for the user, with primary, the config being edited, in
+// the slot of its folder
+func configLayers(primary string) []Layer {
+	var dirs []Layer
+	if dir := os.Getenv("ProgramData"); dir != "" {
+		dirs = append(dirs, Layer{LayerMachine, filepath.Join(dir, "LinkRouter")})
+	}
+	exe, _ := os.Executable()
+	dirs = append(dirs, Layer{LayerPortable, filepath.Dir(exe)})
+	if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+		dirs = append(dirs, Layer{LayerUser, filepath.Join(dir, "LinkRouter")})
+	}
+
+	var layers []Layer
+	hasPrimary := false
+	for _, dir := range dirs {
+		path := findConfig(dir.Path)
+		if samePath(dir.Path, filepath.Dir(primary)) {
+			path, hasPrimary = primary, true
+		}
+		if path != "" && !slices.ContainsFunc(layers, func(l Layer) bool { return samePath(l.Path, path) }) {
+			layers = append(layers, Layer{dir.Name, path})
+		}
+	}
+	if !hasPrimary {
+		layers = append(layers, Layer{LayerUser, primary})
+	}
+	return layers
+}
+
+func samePath(a, b string) bool {
+	return strings.EqualFold(filepath.Clean(a), filepath.Clean(b))
+}
+
+// layerConfig is a layer with its config, read with its includes
+type layerConfig struct {
+	Layer
+	cfg *Config
+}
+
+// ReadLayered reads the config at path merged with the other layers found:
+// the machine-wide config in %ProgramData%\LinkRouter, the portable one next to
+// the executable and the user one in %LOCALAPPDATA%\LinkRouter. Later layers
+// override global settings of earlier ones, unless these locked them.
+// Rules of later layers come first, except locked rules, which stay ahead of
+// all rules of later layers.
+func ReadLayered(path string) (*Config, error) {
+	var layers []layerConfig
+	var failed []Problem
+	for _, l := range configLayers(path) {
+		cfg, err := ReadConfig(l.Path)
+		if err != nil {
+			if l.Path == path {
+				return nil, err
+			}
+			// a broken layer is left out, the rest still works
+			failed = append(failed, Problem{File: l.Path, Rule: -1, Severity: SeverityError, Message: err.Error()})
+			continue
+		}
+		layers = append(layers, layerConfig{l, cfg})
+	}
+	primary := layers[len(layers)-1].cfg
+	if len(layers) == 1 {
+		primary.Layers = []Layer{layers[0].Layer}
+		_, primary.Provenance, _ = mergeGlobals(layers, path)
+		primary.Problems = append(primary.Problems, failed...)
+		primary.checkReferences()
+		return primary, nil
+	}
+
+	merged := &Config{
+		Schema:        primary.Schema,
+		SchemaVersion: primary.SchemaVersion,
+		// profiles are those of the config being edited
+		Profiles: primary.Profiles,
+		extra:    primary.extra,
+	}
+	for _, l := range layers {
+		merged.Layers = append(merged.Layers, l.Layer)
+		// later layers override variables of the same name
+		for name, value := range l.cfg.Variables {
+			if merged.Variables == nil {
+				merged.Variables = map[string]string{}
+			}
+			merged.Variables[name] = value
+		}
+		// and apps
+		for name, app := range l.cfg.Apps {
+			if merged.Apps == nil {
+				merged.Apps = map[string]App{}
+			}
+			merged.Apps[name] = app
+		}
+		if l.cfg == primary {
+			merged.Includes = append(merged.Includes, l.cfg.Includes...)
+			continue
+		}
+		// rules of other layers are saved back to them like included ones
+		for i := range l.cfg.Rules {
+			if l.cfg.Rules[i].File == "" {
+				l.cfg.Rules[i].File = l.Path
+			}
+		}
+		for i := range l.cfg.Problems {
+			if l.cfg.Problems[i].File == "" {
+				l.cfg.Problems[i].File = l.Path
+			}
+		}
+		merged.Includes = append(merged.Includes, l.cfg.Includes...)
+		merged.Includes = append(merged.Includes, IncludeFile{Path: l.Path, ReadOnly: !fileWritable(l.Path), Layer: l.Name})
+	}
+
+	var problems []Problem
+	merged.Global, merged.Provenance, problems = mergeGlobals(layers, path)
+	merged.Global.Include = primary.Global.Include
+	merged.Global.Locked = primary.Global.Locked
+	merged.Global.extra = primary.Global.extra
+
+	// locked rules of a layer go before the rules of all later layers,
+	// otherwise later layers come first
+	type ref struct{ layer, rule int }
+	order := []ref{}
+	for r := range primary.Rules {
+		order = append(order, ref{len(layers) - 1, r})
+	}
+	for i := len(layers) - 2; i >= 0; i-- {
+		var locked, rest []ref
+		for r, rule := range layers[i].cfg.Rules {
+			if rule.Locked {
+				locked = append(locked, ref{i, r})
+			} else {
+				rest = append(rest, ref{i, r})
+			}
+		}
+		order = append(append(locked, order...), rest...)
+	}
+	index := map[ref]int{}
+	for n, at := range order {
+		merged.Rules = append(merged.Rules, layers[at.layer].cfg.Rules[at.rule])
+		index[at] = n
+	}
+	for i, l := range layers {
+		for _, p := range l.cfg.Problems {
+			if p.Rule >= 0 {
+				p.Rule = index[ref{i, p.Rule}]
+			}
+			merged.Problems = append(merged.Problems, p)
+		}
+	}
+	merged.Problems = append(merged.Problems, problems...)
+	merged.Problems = append(merged.Problems, failed...)
+	merged.checkReferences()
+	return merged, nil
+}
+
+// globalFields maps JSON keys of GlobalConfig to field indexes
+func globalFields() map[string]int {
+	fields := map[string]int{}
+	t := reflect.TypeOf(GlobalConfig{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			fields[name] = i
+		}
+	}
+	return fields
+}
+
+// mergeGlobals applies the global settings each layer sets over those of the
+// layers before it. Settings set by a layer after one that locked them are
+// reported and ignored. include and locked apply to their own layer only and
+// are left out. primary is the config being edited.
+func mergeGlobals(layers []layerConfig, primary string) (GlobalConfig, map[string]Provenance, []Problem) {
+	fields := globalFields()
+	var merged GlobalConfig
+	mv := reflect.ValueOf(&merged).Elem()
+	prov := map[string]Provenance{}
+	var problems []Problem
+
+	for _, l := range layers {
+		g := l.cfg.Global
+		gv := reflect.ValueOf(g)
+		keys := make([]string, 0, len(g.set))
+		for key := range g.set {
+			keys = append(keys, key)
+		}
+		slices.Sort(keys)
+		for _, key := range keys {
+			i, ok := fields[key]
+			if !ok || key == "include" || key == "locked" {
+				continue
+			}
+			if p := prov[key]; p.LockedBy != "" {
+				file := l.Path
+				if samePath(file, primary) {
+					file = ""
+				}
+				problems = append(problems, Problem{
+					File: file, Path: "global." + key, Rule: -1, Severity: SeverityWarning,
+					Message: fmt.Sprintf("locked by %s, ignored", p.LockedBy),
+				})
+				continue
+			}
+			mv.Field(i).Set(gv.Field(i))
+			prov[key] = Provenance{Layer: l.Name, File: l.Path}
+		}
+		for _, key := range g.Locked {
+			if p := prov[key]; p.LockedBy == "" {
+				p.LockedBy = l.Path
+				prov[key] = p
+			}
+		}
+	}
+	return merged, prov, problems
+}
+
+// dropInherited removes from the marshaled config the global settings that
+// path doesn't set already and that only repeat what the other layers give,
+// so they keep following those layers. Settings locked by them are dropped too.
+func (c *Config) dropInherited(data []byte, path string) ([]byte, error) {
+	// the config being edited is the last layer
+	var others []layerConfig
+	for _, l := range c.Layers[:len(c.Layers)-1] {
+		if cfg, _, err := readConfigFile(l.Path, false); err == nil {
+			others = append(others, layerConfig{l, cfg})
+		}
+	}
+	inherited, prov, _ := mergeGlobals(others, path)
+	inherited.lookupPrograms()
+	var base, current map[string]json.RawMessage
+	if err := unmarshalCompact(inherited, &base); err != nil {
+		return nil, err
+	}
+	// what the file says now, the effective value of a locked setting isn't its own
+	own := map[string]bool{}
+	var ownVariables map[string]string
+	var ownApps map[string]App
+	if cfg, _, err := readConfigFile(path, false); err == nil {
+		own = cfg.Global.set
+		ownVariables = cfg.Variables
+		ownApps = cfg.Apps
+		unmarshalCompact(cfg.Global, &current)
+	}
+
+	var doc, global map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	if err := unmarshalCompact(doc["global"], &global); err != nil {
+		return nil, err
+	}
+	for key, value := range global {
+		switch {
+		case prov[key].LockedBy != "" && own[key]:
+			global[key] = current[key]
+		case prov[key].LockedBy != "" || !own[key] && bytes.Equal(value, base[key]):
+			delete(global, key)
+		}
+	}
+	var err error
+	if doc["global"], err = json.Marshal(global); err != nil {
+		return nil, err
+	}
+
+	// same for variables and apps
+	inheritedVariables := map[string]string{}
+	inheritedApps := map[string]App{}
+	for _, l := range others {
+		maps.Copy(inheritedVariables, l.cfg.Variables)
+		maps.Copy(inheritedApps, l.cfg.Apps)
+	}
+	if err := dropInheritedEntries(doc, "variables", c.Variables, inheritedVariables, ownVariables); err != nil {
+		return nil, err
+	}
+	if err := dropInheritedEntries(doc, "apps", c.Apps, inheritedApps, ownApps); err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+// dropInheritedEntries sets section key of doc to the entries of all that the
+// file owns already or that differ from the inherited ones
+func dropInheritedEntries[V any](doc map[string]json.RawMessage, key string, all, inherited, own map[string]V) error {
+	entries := map[string]V{}
+	for name, value := range all {
+		_, owned := own[name]
+		if base, ok := inherited[name]; owned || !ok || !reflect.DeepEqual(base, value) {
+			entries[name] = value
+		}
+	}
+	delete(doc, key)
+	if len(entries) == 0 {
+		return nil
+	}
+	var err error
+	doc[key], err = json.Marshal(entries)
+	return err
+}
+
+// unmarshalCompact decodes v, a value or raw JSON, into members without
+// insignificant whitespace so they can be compared
+func unmarshalCompact(v any, members *map[string]json.RawMessage) error {
+	data, ok := v.(json.RawMessage)
+	if !ok {
+		var err error
+		if data, err = json.Marshal(v); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	if err := json.Compact(&buf, data); err != nil {
+		return err
+	}
+	return json.Unmarshal(buf.Bytes(), members)
+}
+
+// writeEmptyConfig creates a config with no settings and rules, for a user
+// whose settings come from other layers
+func writeEmptyConfig(path string) error {
+	data, err := formatOf(path).fromJSON([]byte(fmt.Sprintf(`{"schemaVersion": %d, "rules": []}`, ConfigVersion)), nil)
+	if err != nil {
+		return err
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	return os.WriteFile(path, data, 0600)
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	urlpkg "net/url"
+	"strings"
+)
+
+const extensionPrefix = "linkrouter-ext://"
+
+// Link keeps every form of the link being routed
+type Link struct {
+	// Original is exactly what linkrouter was started with
+	Original string
+	// Raw is the link with the extension wrapper removed, but otherwise untouched
+	Raw string
+	// Decoded is Raw with percent-escapes decoded, which is what rules used to match against
+	Decoded string
+	// FromExtension is set when the link came wrapped by the browser extension
+	FromExtension bool
+}
+
+// ParseLink unwraps links sent by the browser extension and computes the decoded form
+func ParseLink(s string) *Link {
+	link := &Link{Original: strings.TrimSpace(s)}
+	link.Raw = link.Original
+	if strings.HasPrefix(strings.ToLower(link.Raw), extensionPrefix) {
+		link.FromExtension = true
+		// the extension sends encodeURIComponent(url), which has no literal slashes,
+		// so a trailing slash can only be the one windows appends
+		payload := strings.TrimSuffix(link.Raw[len(extensionPrefix):], "/")
+		if unwrapped, err := urlpkg.PathUnescape(payload); err == nil {
+			link.Raw = unwrapped
+		} else {
+			link.Raw = payload
+		}
+	}
+	link.Decoded = link.Raw
+	if decoded, err := urlpkg.QueryUnescape(link.Raw); err == nil {
+		link.Decoded = decoded
+	}
+	return link
+}
+
+// MatchOn values for Rule.MatchOn
+const (
+	MatchOnDecoded = "decoded"
+	MatchOnRaw     = "raw"
+)
+
+func (r *Rule) MatchesRaw() bool {
+	return strings.EqualFold(r.MatchOn, MatchOnRaw)
+}
+
+// Target returns the form of the link rule's conditions run against.
+// Without a rule (fallback) that is the raw link.
+func (l *Link) Target(rule *Rule) string {
+	if rule == nil || rule.MatchesRaw() {
+		return l.Raw
+	}
+	return l.Decoded
+}
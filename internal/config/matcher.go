@@ -0,0 +1,319 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"linkrouter/internal/logger"
+	"linkrouter/internal/template"
+	"os"
+	"path/filepath"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+	"time"
+)
+
+// compiledRule holds everything needed to match a rule without re-parsing it.
+// literals are substrings every match must contain, so a rule whose literals
+// are missing from the URL is skipped without running the regex at all.
+type compiledRule struct {
+	regex    string
+	literals []string
+	re       *regexp.Regexp
+	err      error
+	exclude  []*compiledRule
+}
+
+// ruleCache is persisted between runs, since linkrouter is started for every link.
+// It is keyed by config path and modification time.
+type ruleCache struct {
+	ConfigPath string       `json:"configPath"`
+	ModTime    time.Time    `json:"modTime"`
+	Size       int64        `json:"size"`
+	Rules      []cachedRule `json:"rules"`
+}
+
+type cachedRule struct {
+	Regex    string       `json:"regex"`
+	Literals []string     `json:"literals,omitempty"`
+	Err      string       `json:"err,omitempty"`
+	Exclude  []cachedRule `json:"exclude,omitempty"`
+}
+
+// shortest literal worth checking before running a regex
+const minPrefilterLiteral = 2
+
+func analyzeRule(rule *Rule) *compiledRule {
+	cr := analyzeRegex(rule.Regex)
+	for _, ex := range rule.Exclude {
+		cr.exclude = append(cr.exclude, analyzeRegex(ex.Regex))
+	}
+	return cr
+}
+
+func analyzeRegex(regex string) *compiledRule {
+	cr := &compiledRule{regex: regex}
+	parsed, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		cr.err = err
+		return cr
+	}
+	for _, lit := range requiredLiterals(parsed) {
+		if len(lit) >= minPrefilterLiteral {
+			cr.literals = append(cr.literals, lit)
+		}
+	}
+	return cr
+}
+
+// requiredLiterals returns case-sensitive literals that any match of re must contain.
+// It is conservative: when unsure it returns nothing, which disables the prefilter.
+func requiredLiterals(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if re.Flags&syntax.FoldCase != 0 {
+			return nil
+		}
+		return []string{string(re.Rune)}
+	case syntax.OpConcat:
+		var lits []string
+		for _, sub := range re.Sub {
+			lits = append(lits, requiredLiterals(sub)...)
+		}
+		return lits
+	case syntax.OpCapture, syntax.OpPlus:
+		return requiredLiterals(re.Sub[0])
+	case syntax.OpRepeat:
+		if re.Min >= 1 {
+			return requiredLiterals(re.Sub[0])
+		}
+	}
+	return nil
+}
+
+// isFor reports whether cr was built from the current regexes of rule
+func (cr *compiledRule) isFor(rule *Rule) bool {
+	if cr.regex != rule.Regex || len(cr.exclude) != len(rule.Exclude) {
+		return false
+	}
+	for i, ex := range rule.Exclude {
+		if cr.exclude[i].regex != ex.Regex {
+			return false
+		}
+	}
+	return true
+}
+
+func (cr *compiledRule) toCache() cachedRule {
+	cached := cachedRule{Regex: cr.regex, Literals: cr.literals}
+	if cr.err != nil {
+		cached.Err = cr.err.Error()
+	}
+	for _, ex := range cr.exclude {
+		cached.Exclude = append(cached.Exclude, ex.toCache())
+	}
+	return cached
+}
+
+func (cached cachedRule) toCompiled() *compiledRule {
+	cr := &compiledRule{regex: cached.Regex, literals: cached.Literals}
+	if cached.Err != "" {
+		cr.err = fmt.Errorf("%s", cached.Err)
+	}
+	for _, ex := range cached.Exclude {
+		cr.exclude = append(cr.exclude, ex.toCompiled())
+	}
+	return cr
+}
+
+// compile returns the regex, compiling it on first use
+func (cr *compiledRule) compile() (*regexp.Regexp, error) {
+	if cr.re == nil && cr.err == nil {
+		cr.re, cr.err = regexp.Compile(cr.regex)
+	}
+	return cr.re, cr.err
+}
+
+// prefilter reports whether url may match, based on literals alone
+func (cr *compiledRule) prefilter(url string) bool {
+	for _, lit := range cr.literals {
+		if !strings.Contains(url, lit) {
+			return false
+		}
+	}
+	return true
+}
+
+// compiledRules returns per-rule matchers, rebuilding any that went stale
+// because the rules were edited after load (GUI).
+func (c *Config) compiledRules() []*compiledRule {
+	if len(c.compiled) != len(c.Rules) {
+		c.compiled = make([]*compiledRule, len(c.Rules))
+	}
+	for i := range c.Rules {
+		if c.compiled[i] == nil || !c.compiled[i].isFor(&c.Rules[i]) {
+			c.compiled[i] = analyzeRule(&c.Rules[i])
+		}
+	}
+	return c.compiled
+}
+
+func ruleCachePath(configPath string) string {
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	h := fnv.New32a()
+	h.Write([]byte(strings.ToLower(filepath.Clean(configPath))))
+	return filepath.Join(cacheDir, "LinkRouter", fmt.Sprintf("rules-%08x.json", h.Sum32()))
+}
+
+// loadCompiledRules fills c.compiled from the on-disk cache when it is fresh,
+// and refreshes the cache otherwise.
+func (c *Config) loadCompiledRules(configPath string) {
+	info, err := os.Stat(configPath)
+	if err != nil {
+		c.compiledRules()
+		return
+	}
+	cachePath := ruleCachePath(configPath)
+	if cachePath == "" {
+		c.compiledRules()
+		return
+	}
+
+	if data, err := os.ReadFile(cachePath); err == nil {
+		var cache ruleCache
+		if json.Unmarshal(data, &cache) == nil &&
+			cache.ConfigPath == configPath &&
+			cache.ModTime.Equal(info.ModTime()) &&
+			cache.Size == info.Size() &&
+			len(cache.Rules) == len(c.Rules) {
+			c.compiled = make([]*compiledRule, len(c.Rules))
+			for i, cached := range cache.Rules {
+				c.compiled[i] = cached.toCompiled()
+			}
+			// entries whose regex doesn't match the rule are rebuilt here
+			c.compiledRules()
+			return
+		}
+	}
+
+	cache := ruleCache{
+		ConfigPath: configPath,
+		ModTime:    info.ModTime(),
+		Size:       info.Size(),
+	}
+	for _, cr := range c.compiledRules() {
+		cache.Rules = append(cache.Rules, cr.toCache())
+	}
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return
+	}
+	os.MkdirAll(filepath.Dir(cachePath), 0755)
+	if err := os.WriteFile(cachePath, data, 0600); err != nil {
+		logger.Log(fmt.Sprintf("Can't write rule cache %q: %s", cachePath, err))
+	}
+}
+
+// matchRule evaluates one rule against the target.
+// excludedBy is the index of the exclusion that rejected an otherwise matching rule, or -1.
+// err is only set when the rule itself is broken.
+func matchRule(rule *Rule, cr *compiledRule, target *matchTarget) (matches []string, excludedBy int, err error) {
+	matches, err = matchConditions(rule.Regex, &rule.URLMatcher, cr, target)
+	if err != nil || len(matches) == 0 {
+		return nil, -1, err
+	}
+	for i := range rule.Exclude {
+		ex := &rule.Exclude[i]
+		if ex.Regex == "" && ex.URLMatcher.IsEmpty() {
+			continue
+		}
+		excluded, err := matchConditions(ex.Regex, &ex.URLMatcher, cr.exclude[i], target)
+		if err != nil {
+			return nil, -1, fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+		if len(excluded) > 0 {
+			return nil, i, nil
+		}
+	}
+	return matches, -1, nil
+}
+
+// matchConditions checks a regex together with structured URL conditions
+func matchConditions(regex string, m *URLMatcher, cr *compiledRule, target *matchTarget) ([]string, error) {
+	if cr.err == nil && !cr.prefilter(target.url) {
+		return nil, nil
+	}
+	re, err := cr.compile()
+	if err != nil {
+		return nil, err
+	}
+	if !m.IsEmpty() {
+		if !m.Match(target.URL()) {
+			return nil, nil
+		}
+		if regex == "" {
+			return []string{target.url}, nil
+		}
+	}
+	return re.FindStringSubmatch(target.url), nil
+}
+
+// Validate reports the first problem that prevents the rule from matching
+func (r *Rule) Validate() error {
+	if _, err := regexp.Compile(r.Regex); err != nil {
+		return err
+	}
+	for i, ex := range r.Exclude {
+		if _, err := regexp.Compile(ex.Regex); err != nil {
+			return fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+	}
+	if err := r.validateGlobs(); err != nil {
+		return err
+	}
+	if _, err := template.Parse(r.Arguments); err != nil {
+		return fmt.Errorf("arguments: %w", err)
+	}
+	for i, arg := range r.Args {
+		if _, err := template.Parse(arg); err != nil {
+			return fmt.Errorf("args[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// GroupNames returns capture group names of the rule regex, for named placeholders
+func (r *Rule) GroupNames() []string {
+	re, err := regexp.Compile(r.Regex)
+	if err != nil {
+		return nil
+	}
+	return re.SubexpNames()
+}
+
+// validateGlobs checks structured conditions only, regexes are checked when compiled
+func (r *Rule) validateGlobs() error {
+	if err := r.URLMatcher.Validate(); err != nil {
+		return err
+	}
+	for i, ex := range r.Exclude {
+		if err := ex.URLMatcher.Validate(); err != nil {
+			return fmt.Errorf("exclude[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Match evaluates a single rule outside of a config, e.g. for the GUI rule editor
+func (r *Rule) Match(url string) ([]string, error) {
+	if err := r.Validate(); err != nil {
+		return nil, err
+	}
+	target := newMatchTarget(ParseLink(url).Target(r))
+	matches, _, err := matchRule(r, analyzeRule(r), target)
+	return matches, err
+}
@@ -0,0 +1,209 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ConfigVersion is the schemaVersion this build writes. Older configs are
+// migrated on load, newer ones were written by a newer LinkRouter and get a warning.
+const ConfigVersion = 1
+
+// Migration upgrades a config document from version From to From+1.
+// Apply works on the decoded document, numbers are json.Number, so every
+// step can be tested on its own without touching files.
+type Migration struct {
+	From        int
+	Description string
+	Apply       func(doc map[string]any) error
+}
+
+// migrations by the version they upgrade from. A change of the format raises
+// ConfigVersion and registers the step from the previous one in an init func.
+var migrations = map[int]Migration{}
+
+func registerMigration(m Migration) {
+	if _, ok := migrations[m.From]; ok {
+		panic(fmt.Sprintf("config: duplicate migration from version %d", m.From))
+	}
+	migrations[m.From] = m
+}
+
+// documentVersion is the schemaVersion of doc. Configs written before it
+// existed are version 1.
+func documentVersion(doc map[string]any) (int, error) {
+	v, ok := doc["schemaVersion"]
+	if !ok {
+		return 1, nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return 0, fmt.Errorf("schemaVersion must be a number, got %v", v)
+	}
+	version, err := n.Int64()
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("invalid schemaVersion %s", n)
+	}
+	return int(version), nil
+}
+
+// MigrationResult describes the upgrade of a config file
+type MigrationResult struct {
+	Path string
+	From int
+	To   int
+	// Steps are the descriptions of the migrations applied
+	Steps []string
+	// Backup is where the original was saved, empty on dry run
+	Backup string
+	// Diff is a unified diff of the file
+	Diff string
+}
+
+// Migrate upgrades the config at path to ConfigVersion. The original is saved
+// next to it as <name>.bak-v<version> before the upgraded form is written.
+// With dryRun nothing is written. Configs that are current, or newer than
+// this build, are left alone and From equals To.
+func Migrate(path string, dryRun bool) (*MigrationResult, error) {
+	res := &MigrationResult{Path: path}
+	original, upgraded, err := rewriteDoc(path, func(doc map[string]any) error {
+		from, err := documentVersion(doc)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		res.From = from
+		res.To, res.Steps, err = migrateDoc(doc, from, ConfigVersion)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.From >= res.To {
+		return res, nil
+	}
+
+	res.Diff = unifiedDiff(path, path+" (upgraded)", original, upgraded)
+	if dryRun {
+		return res, nil
+	}
+	res.Backup = fmt.Sprintf("%s.bak-v%d", path, res.From)
+	if err := os.WriteFile(res.Backup, original, 0600); err != nil {
+		return nil, fmt.Errorf("can't back up %s: %w", path, err)
+	}
+	if err := os.WriteFile(path, upgraded, 0600); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// migrateDoc applies the registered migrations to doc, from version from up
+// to version to, and returns the version reached with the descriptions of the
+// steps applied
+func migrateDoc(doc map[string]any, from, to int) (int, []string, error) {
+	var steps []string
+	for v := from; v < to; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			return v, steps, fmt.Errorf("no migration from config version %d", v)
+		}
+		if err := m.Apply(doc); err != nil {
+			return v, steps, fmt.Errorf("migration from version %d: %w", v, err)
+		}
+		doc["schemaVersion"] = v + 1
+		steps = append(steps, m.Description)
+	}
+	return max(from, to), steps, nil
+}
+
+// diffLine is a line of a diff, op is ' ', '-' or '+'. a and b are its
+// 1-based line numbers in the old and new text.
+type diffLine struct {
+	op   byte
+	text string
+	a, b int
+}
+
+// unifiedDiff is a line diff of a and b with 3 lines of context
+func unifiedDiff(nameA, nameB string, a, b []byte) string {
+	x := splitLines(a)
+	y := splitLines(b)
+
+	// longest common subsequence, lcs[i][j] is for x[i:] and y[j:]
+	lcs := make([][]int, len(x)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(y)+1)
+	}
+	for i := len(x) - 1; i >= 0; i-- {
+		for j := len(y) - 1; j >= 0; j-- {
+			if x[i] == y[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(x) || j < len(y) {
+		switch {
+		case i < len(x) && j < len(y) && x[i] == y[j]:
+			lines = append(lines, diffLine{' ', x[i], i + 1, j + 1})
+			i++
+			j++
+		case i < len(x) && (j == len(y) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', x[i], i + 1, j + 1})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', y[j], i + 1, j + 1})
+			j++
+		}
+	}
+
+	const context = 3
+	var out bytes.Buffer
+	for start := 0; start < len(lines); {
+		if lines[start].op == ' ' {
+			start++
+			continue
+		}
+		// changes less than 2*context lines apart share a hunk
+		end := start
+		for k := start; k < len(lines) && k-end <= 2*context; k++ {
+			if lines[k].op != ' ' {
+				end = k
+			}
+		}
+		hunk := lines[max(start-context, 0) : min(end+context, len(lines)-1)+1]
+
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		countA, countB := 0, 0
+		for _, l := range hunk {
+			if l.op != '+' {
+				countA++
+			}
+			if l.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%d,%d +%d,%d @@\n", hunk[0].a, countA, hunk[0].b, countB)
+		for _, l := range hunk {
+			fmt.Fprintf(&out, "%c%s\n", l.op, l.text)
+		}
+		start = end + context + 1
+	}
+	return out.String()
+}
+
+func splitLines(data []byte) []string {
+	s := strings.TrimSuffix(strings.ReplaceAll(string(data), "\r\n", "\n"), "\n")
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, "\n")
+}
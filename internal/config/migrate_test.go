@@ -0,0 +1,145 @@
+package config
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// baselineConfig is a config as written before schemaVersion existed
+const baselineConfig = `{
+  // comments are kept
+  "global": {
+    "fallbackBrowserPath": "C:\\Program Files\\Mozilla Firefox\\firefox.exe",
+    "fallbackBrowserArgs": "\"{URL}\"",
+    "defaultConfigEditor": "notepad.exe",
+    "logPath": "",
+    "interactiveMode": false,
+    "supportedProtocols": ["http", "https"]
+  },
+  "rules": [
+    { "regex": "^https://zoom\\.us/j/(\\d+)", "program": "zoom.exe", "arguments": "$1" }
+  ]
+}
+`
+
+func TestMigrationChainIsComplete(t *testing.T) {
+	for v := 1; v < ConfigVersion; v++ {
+		m, ok := migrations[v]
+		if !ok {
+			t.Errorf("no migration from version %d", v)
+			continue
+		}
+		if m.From != v || m.Description == "" || m.Apply == nil {
+			t.Errorf("migration from version %d is incomplete: %+v", v, m)
+		}
+	}
+	for from := range migrations {
+		if from < 1 || from >= ConfigVersion {
+			t.Errorf("migration from version %d is outside 1..%d", from, ConfigVersion-1)
+		}
+	}
+}
+
+func TestMigrateBaselineConfigIsCurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "linkrouter.json")
+	if err := os.WriteFile(path, []byte(baselineConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := Migrate(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.From != 1 || res.To != ConfigVersion || res.Backup != "" {
+		t.Errorf("Migrate = %+v, want version 1 upgraded to %d", res, ConfigVersion)
+	}
+	data, _ := os.ReadFile(path)
+	if ConfigVersion == 1 && string(data) != baselineConfig {
+		t.Errorf("current config was rewritten:\n%s", data)
+	}
+	if matches, _ := filepath.Glob(path + ".bak-*"); ConfigVersion == 1 && len(matches) > 0 {
+		t.Errorf("current config was backed up as %v", matches)
+	}
+	if _, err := ReadConfig(path); err != nil {
+		t.Errorf("migrated config doesn't load: %v", err)
+	}
+}
+
+// withMigrations replaces the registered migrations for the test
+func withMigrations(t *testing.T, steps ...Migration) {
+	saved := migrations
+	migrations = map[int]Migration{}
+	for _, m := range steps {
+		registerMigration(m)
+	}
+	t.Cleanup(func() { migrations = saved })
+}
+
+func TestMigrateDocAppliesStepsInOrder(t *testing.T) {
+	withMigrations(t,
+		Migration{From: 2, Description: "b", Apply: func(doc map[string]any) error {
+			doc["order"] = doc["order"].(string) + "b"
+			return nil
+		}},
+		Migration{From: 1, Description: "a", Apply: func(doc map[string]any) error {
+			doc["order"] = "a"
+			return nil
+		}},
+	)
+
+	doc := map[string]any{}
+	to, steps, err := migrateDoc(doc, 1, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if to != 3 || !reflect.DeepEqual(steps, []string{"a", "b"}) {
+		t.Errorf("migrateDoc = %d, %v, want 3, [a b]", to, steps)
+	}
+	if doc["order"] != "ab" || doc["schemaVersion"] != 3 {
+		t.Errorf("doc = %v, want order ab and schemaVersion 3", doc)
+	}
+
+	// a config newer than the target is left alone
+	if to, steps, err := migrateDoc(map[string]any{}, 5, 3); to != 5 || steps != nil || err != nil {
+		t.Errorf("migrateDoc from 5 to 3 = %d, %v, %v, want 5, none", to, steps, err)
+	}
+}
+
+func TestMigrateDocReportsGaps(t *testing.T) {
+	withMigrations(t, Migration{From: 1, Description: "a", Apply: func(map[string]any) error { return nil }})
+
+	to, steps, err := migrateDoc(map[string]any{}, 1, 3)
+	if err == nil || !strings.Contains(err.Error(), "version 2") {
+		t.Errorf("migrateDoc over a gap: err = %v, want no migration from version 2", err)
+	}
+	if to != 2 || len(steps) != 1 {
+		t.Errorf("migrateDoc over a gap = %d, %v, want 2, [a]", to, steps)
+	}
+}
+
+func TestDocumentVersion(t *testing.T) {
+	for src, want := range map[string]int{`{}`: 1, `{"schemaVersion": 1}`: 1, `{"schemaVersion": 4}`: 4} {
+		var doc map[string]any
+		dec := json.NewDecoder(strings.NewReader(src))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if got, err := documentVersion(doc); got != want || err != nil {
+			t.Errorf("documentVersion(%s) = %d, %v, want %d", src, got, err, want)
+		}
+	}
+	for _, src := range []string{`{"schemaVersion": "2"}`, `{"schemaVersion": 0}`, `{"schemaVersion": 1.5}`} {
+		var doc map[string]any
+		dec := json.NewDecoder(strings.NewReader(src))
+		dec.UseNumber()
+		dec.Decode(&doc)
+		if _, err := documentVersion(doc); err == nil {
+			t.Errorf("documentVersion(%s) succeeded, want an error", src)
+		}
+	}
+}
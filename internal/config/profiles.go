@@ -0,0 +1,173 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"linkrouter/internal/logger"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"time"
+)
+
+// Profile is a named set of changes to the config, such as "work" or "home".
+// The active one is picked with --profile and remembered in State.
+type Profile struct {
+	// Global overrides settings of the global section
+	Global map[string]json.RawMessage `json:"global,omitempty"`
+	// Rules are checked before the rules of the config
+	Rules []Rule `json:"rules,omitempty"`
+	// Disable lists names of rules that are off while the profile is active
+	Disable []string `json:"disable,omitempty"`
+}
+
+// ActiveProfile is the profile applied by ApplyProfile, empty for none.
+// Available to argument templates as {PROFILE}.
+var ActiveProfile string
+
+// ProfileNames returns the names of the profiles, sorted
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
+
+// ApplyProfile changes the config as profile name says, "" applies none.
+// Settings locked by another config layer are left as they are.
+func (c *Config) ApplyProfile(name string) error {
+	ActiveProfile = ""
+	if name == "" {
+		return nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	path := "profiles." + name
+
+	fields := globalFields()
+	gv := reflect.ValueOf(&c.Global).Elem()
+	keys := make([]string, 0, len(p.Global))
+	for key := range p.Global {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		i, ok := fields[key]
+		if !ok || key == "include" || key == "locked" {
+			continue
+		}
+		if by := c.Provenance[key].LockedBy; by != "" {
+			c.Problems = append(c.Problems, Problem{Path: path + ".global." + key, Rule: -1, Severity: SeverityWarning,
+				Message: fmt.Sprintf("locked by %s, ignored", by)})
+			continue
+		}
+		value := reflect.New(gv.Field(i).Type())
+		if err := json.Unmarshal(p.Global[key], value.Interface()); err != nil {
+			// reported by validateConfig already
+			continue
+		}
+		gv.Field(i).Set(value.Elem())
+	}
+	c.Global.lookupPrograms()
+	SupportedProtocols = c.Global.SupportedProtocols
+
+	for i, ruleName := range p.Disable {
+		found := false
+		for j := range c.Rules {
+			if c.Rules[j].Name != ruleName {
+				continue
+			}
+			found = true
+			if c.Rules[j].disabled == "" {
+				c.Rules[j].disabled = fmt.Sprintf("disabled by profile %s", name)
+			}
+		}
+		if !found {
+			c.Problems = append(c.Problems, Problem{Path: fmt.Sprintf("%s.disable[%d]", path, i), Rule: -1,
+				Severity: SeverityWarning, Message: fmt.Sprintf("no rule named %q", ruleName)})
+		}
+	}
+
+	// the profile's rules go first, problems of the config's rules move along
+	for i := range c.Problems {
+		if c.Problems[i].Rule >= 0 {
+			c.Problems[i].Rule += len(p.Rules)
+		}
+	}
+	c.Rules = append(slices.Clone(p.Rules), c.Rules...)
+	c.compiled = nil
+
+	ActiveProfile = name
+	return nil
+}
+
+// ApplyActiveProfile applies the profile saved with SetActiveProfile.
+// A profile that no longer exists is reported and none is applied.
+func (c *Config) ApplyActiveProfile() {
+	name := LoadState().Profile
+	if err := c.ApplyProfile(name); err != nil {
+		logger.Log(fmt.Sprintf("Error: active profile: %s, using none", err))
+		c.Problems = append(c.Problems, Problem{Path: "profiles", Rule: -1, Severity: SeverityWarning,
+			Message: fmt.Sprintf("active profile: %s, using none", err)})
+		return
+	}
+	if name != "" {
+		logger.Log("Active profile: " + name)
+	}
+}
+
+// SetActiveProfile remembers name as the profile to apply from now on,
+// "" for none
+func (c *Config) SetActiveProfile(name string) error {
+	if _, ok := c.Profiles[name]; name != "" && !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	state := LoadState()
+	state.Profile = name
+	return state.Save()
+}
+
+// State is what LinkRouter remembers between runs, kept apart from the config
+// so that switching a profile doesn't rewrite it
+type State struct {
+	// Profile is the active profile, see Config.Profiles
+	Profile string `json:"profile,omitempty"`
+	// FailedFallbacks holds when fallback browsers failed to start, by Key,
+	// see RecordFallbacks
+	FailedFallbacks map[string]time.Time `json:"failedFallbacks,omitempty"`
+	// NewerVersionShown is the config version last reported as newer than
+	// this LinkRouter, see showNewerVersion
+	NewerVersionShown int `json:"newerVersionShown,omitempty"`
+}
+
+func statePath() string {
+	if dir := os.Getenv("LOCALAPPDATA"); dir != "" {
+		return filepath.Join(dir, "LinkRouter", "state.json")
+	}
+	exe, _ := os.Executable()
+	return filepath.Join(filepath.Dir(exe), "linkrouter.state.json")
+}
+
+// LoadState reads the saved state, a missing or broken file is an empty state
+func LoadState() State {
+	var state State
+	if data, err := os.ReadFile(statePath()); err == nil {
+		json.Unmarshal(data, &state)
+	}
+	return state
+}
+
+func (s State) Save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := statePath()
+	os.MkdirAll(filepath.Dir(path), 0755)
+	return os.WriteFile(path, data, 0600)
+}
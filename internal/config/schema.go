@@ -0,0 +1,183 @@
+package config
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// schemaJSON is the published JSON Schema of linkrouter.json. Editors use it
+// for completion, the loader validates against the same file.
+//
+//go:embed linkrouter.schema.json
+var schemaJSON []byte
+
+// Schema returns the JSON Schema of the config file
+func Schema() []byte {
+	return schemaJSON
+}
+
+// schemaValidator checks a parsed document against the subset of JSON Schema
+// used by linkrouter.schema.json: type, enum, properties,
+// additionalProperties, items, anyOf and local $ref
+type schemaValidator struct {
+	root     map[string]any
+	data     []byte
+	problems []Problem
+}
+
+func newSchemaValidator(data []byte) *schemaValidator {
+	v := &schemaValidator{data: data}
+	if err := json.Unmarshal(schemaJSON, &v.root); err != nil {
+		panic("linkrouter.schema.json: " + err.Error())
+	}
+	return v
+}
+
+func (v *schemaValidator) add(path string, node *jsonNode, severity, format string, args ...any) {
+	v.problems = append(v.problems, newProblem(v.data, path, node, severity, fmt.Sprintf(format, args...)))
+}
+
+// resolve follows a local "#/a/b" reference
+func (v *schemaValidator) resolve(ref string) map[string]any {
+	var cur any = v.root
+	for _, part := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		m, _ := cur.(map[string]any)
+		cur = m[part]
+	}
+	s, _ := cur.(map[string]any)
+	return s
+}
+
+func (v *schemaValidator) check(s map[string]any, node *jsonNode, path string) {
+	if ref, ok := s["$ref"].(string); ok {
+		s = v.resolve(ref)
+	}
+	if s == nil {
+		return
+	}
+
+	if anyOf, ok := s["anyOf"].([]any); ok {
+		v.checkAnyOf(anyOf, node, path)
+		return
+	}
+
+	if types := schemaTypes(s); len(types) > 0 && !hasType(types, node.kind) {
+		v.add(path, node, SeverityError, "expected %s, got %s", strings.Join(types, " or "), node.kind)
+		return
+	}
+
+	if enum, ok := s["enum"].([]any); ok {
+		var value any
+		json.Unmarshal([]byte(node.raw), &value)
+		found := false
+		var names []string
+		for _, e := range enum {
+			names = append(names, fmt.Sprintf("%q", e))
+			a, aok := e.(string)
+			b, bok := value.(string)
+			if e == value || (aok && bok && strings.EqualFold(a, b)) {
+				found = true
+			}
+		}
+		if !found {
+			v.add(path, node, SeverityError, "must be one of %s, got %s", strings.Join(names, ", "), node.raw)
+			return
+		}
+	}
+
+	switch node.kind {
+	case "object":
+		props, _ := s["properties"].(map[string]any)
+		seen := map[string]bool{}
+		for _, f := range node.fields {
+			fieldPath := joinPath(path, f.key)
+			if seen[f.key] {
+				v.add(fieldPath, f.value, SeverityWarning, "duplicate key %q, the last one wins", f.key)
+			}
+			seen[f.key] = true
+			if prop, ok := props[f.key].(map[string]any); ok {
+				v.check(prop, f.value, fieldPath)
+				continue
+			}
+			switch extra := s["additionalProperties"].(type) {
+			case bool:
+				if !extra {
+					v.problems = append(v.problems,
+						newProblemAt(v.data, fieldPath, f.offset, SeverityWarning, fmt.Sprintf("unknown key %q", f.key)))
+				}
+			case map[string]any:
+				v.check(extra, f.value, fieldPath)
+			}
+		}
+	case "array":
+		if items, ok := s["items"].(map[string]any); ok {
+			for i, item := range node.items {
+				v.check(items, item, fmt.Sprintf("%s[%d]", path, i))
+			}
+		}
+	}
+}
+
+// checkAnyOf accepts the node when one alternative has no errors. Otherwise
+// problems of the alternative of the right type are reported.
+func (v *schemaValidator) checkAnyOf(anyOf []any, node *jsonNode, path string) {
+	var expected []string
+	var best []Problem
+	bestSet := false
+	for _, alt := range anyOf {
+		s, _ := alt.(map[string]any)
+		sub := &schemaValidator{root: v.root, data: v.data}
+		sub.check(s, node, path)
+		if !hasErrors(sub.problems) {
+			v.problems = append(v.problems, sub.problems...)
+			return
+		}
+		if ref, ok := s["$ref"].(string); ok {
+			s = v.resolve(ref)
+		}
+		types := schemaTypes(s)
+		expected = append(expected, types...)
+		if hasType(types, node.kind) && !bestSet {
+			best, bestSet = sub.problems, true
+		}
+	}
+	if bestSet {
+		v.problems = append(v.problems, best...)
+		return
+	}
+	v.add(path, node, SeverityError, "expected %s, got %s", strings.Join(expected, " or "), node.kind)
+}
+
+func schemaTypes(s map[string]any) []string {
+	switch t := s["type"].(type) {
+	case string:
+		return []string{t}
+	case []any:
+		var types []string
+		for _, e := range t {
+			if name, ok := e.(string); ok {
+				types = append(types, name)
+			}
+		}
+		return types
+	}
+	return nil
+}
+
+func hasType(types []string, kind string) bool {
+	for _, t := range types {
+		if t == kind || (t == "integer" && kind == "number") {
+			return true
+		}
+	}
+	return false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
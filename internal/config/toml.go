@@ -0,0 +1,337 @@
+package config
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// TOML is rewritten on save, comments are not kept
+var tomlFormat = &configFormat{
+	name:     "TOML",
+	toJSON:   tomlToJSON,
+	fromJSON: func(doc, _ []byte) ([]byte, error) { return jsonToTOML(doc) },
+}
+
+func tomlToJSON(data []byte) ([]byte, func(string) (int, int), error) {
+	var v map[string]any
+	md, err := toml.Decode(string(data), &v)
+	if err != nil {
+		return nil, nil, err
+	}
+	// the decoder returns maps, key order is restored from the metadata
+	order := map[string]int{}
+	for i, key := range md.Keys() {
+		if _, ok := order[key.String()]; !ok {
+			order[key.String()] = i
+		}
+	}
+	var out bytes.Buffer
+	if err := writeTOMLAsJSON(&out, v, nil, order); err != nil {
+		return nil, nil, err
+	}
+	locate := func(path string) (int, int) {
+		return locateTOML(data, splitPath(path))
+	}
+	return out.Bytes(), locate, nil
+}
+
+func writeTOMLAsJSON(out *bytes.Buffer, v any, key toml.Key, order map[string]int) error {
+	switch v := v.(type) {
+	case map[string]any:
+		names := make([]string, 0, len(v))
+		for name := range v {
+			names = append(names, name)
+		}
+		rank := func(name string) int {
+			if i, ok := order[append(slices.Clone(key), name).String()]; ok {
+				return i
+			}
+			return len(order)
+		}
+		slices.SortStableFunc(names, func(a, b string) int {
+			if ra, rb := rank(a), rank(b); ra != rb {
+				return ra - rb
+			}
+			return strings.Compare(a, b)
+		})
+		out.WriteByte('{')
+		for i, name := range names {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			data, _ := json.Marshal(name)
+			out.Write(data)
+			out.WriteByte(':')
+			if err := writeTOMLAsJSON(out, v[name], append(slices.Clone(key), name), order); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case []map[string]any:
+		out.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeTOMLAsJSON(out, item, key, order); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case []any:
+		out.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeTOMLAsJSON(out, item, key, order); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		out.Write(data)
+	}
+	return nil
+}
+
+var (
+	tomlHeader = regexp.MustCompile(`^\s*(\[\[?)\s*([^\]]+?)\s*\]\]?`)
+	tomlKey    = regexp.MustCompile(`^\s*("[^"]*"|'[^']*'|[A-Za-z0-9_.-]+)\s*=`)
+)
+
+// locateTOML finds the line of the key or table at path by scanning the text,
+// as the decoder doesn't expose positions. Values inside inline tables and
+// arrays are reported at the line of their key.
+func locateTOML(data []byte, path []any) (int, int) {
+	want := fmtPath(path)
+	bestLen, bestLine, bestCol := -1, 0, 0
+	consider := func(p string, line, col int) {
+		if (p == want || strings.HasPrefix(want, p+".") || strings.HasPrefix(want, p+"[")) && len(p) > bestLen {
+			bestLen, bestLine, bestCol = len(p), line, col
+		}
+	}
+
+	counts := map[string]int{}
+	table := ""
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if m := tomlHeader.FindStringSubmatchIndex(text); m != nil {
+			// a.b under [[a]] is the b of the last a
+			table = ""
+			parts := splitTOMLKey(text[m[4]:m[5]])
+			for i, part := range parts {
+				table = joinPath(table, part)
+				if n, ok := counts[table]; ok && i < len(parts)-1 {
+					table = fmt.Sprintf("%s[%d]", table, n-1)
+				}
+			}
+			if text[m[2]:m[3]] == "[[" {
+				n := counts[table]
+				counts[table] = n + 1
+				table = fmt.Sprintf("%s[%d]", table, n)
+			}
+			consider(table, line, m[4]+1)
+			continue
+		}
+		if m := tomlKey.FindStringSubmatchIndex(text); m != nil {
+			p := table
+			for _, part := range splitTOMLKey(text[m[2]:m[3]]) {
+				p = joinPath(p, part)
+			}
+			consider(p, line, m[2]+1)
+		}
+	}
+	return bestLine, bestCol
+}
+
+func splitTOMLKey(key string) []string {
+	var parts []string
+	for _, part := range strings.Split(key, ".") {
+		parts = append(parts, strings.Trim(strings.TrimSpace(part), `"'`))
+	}
+	return parts
+}
+
+func fmtPath(path []any) string {
+	s := ""
+	for _, seg := range path {
+		switch seg := seg.(type) {
+		case string:
+			s = joinPath(s, seg)
+		case int:
+			s += fmt.Sprintf("[%d]", seg)
+		}
+	}
+	return s
+}
+
+// jsonToTOML writes keys in document order. Objects become tables, arrays of
+// objects arrays of tables, anything nested in arrays inline tables.
+// Strings use literal quotes when they can, so regexes need no escaping.
+func jsonToTOML(doc []byte) ([]byte, error) {
+	tree, err := parseJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	if tree.kind != "object" {
+		return nil, fmt.Errorf("top level must be an object")
+	}
+	var out bytes.Buffer
+	if err := writeTOMLTable(&out, tree, nil); err != nil {
+		return nil, err
+	}
+	return bytes.TrimLeft(out.Bytes(), "\n"), nil
+}
+
+func isTOMLTableArray(n *jsonNode) bool {
+	if n.kind != "array" || len(n.items) == 0 {
+		return false
+	}
+	for _, item := range n.items {
+		if item.kind != "object" {
+			return false
+		}
+	}
+	return true
+}
+
+func writeTOMLTable(out *bytes.Buffer, n *jsonNode, path []string) error {
+	// TOML has no null, a null key is the same as a missing one for the config
+	for _, f := range n.fields {
+		if f.value.kind == "object" || f.value.kind == "null" || isTOMLTableArray(f.value) {
+			continue
+		}
+		value, err := tomlInline(f.value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", strings.Join(append(path, f.key), "."), err)
+		}
+		fmt.Fprintf(out, "%s = %s\n", tomlKeyString(f.key), value)
+	}
+	for _, f := range n.fields {
+		sub := append(slices.Clone(path), f.key)
+		switch {
+		case f.value.kind == "object":
+			fmt.Fprintf(out, "\n[%s]\n", tomlHeaderString(sub))
+			if err := writeTOMLTable(out, f.value, sub); err != nil {
+				return err
+			}
+		case isTOMLTableArray(f.value):
+			for _, item := range f.value.items {
+				fmt.Fprintf(out, "\n[[%s]]\n", tomlHeaderString(sub))
+				if err := writeTOMLTable(out, item, sub); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func tomlInline(n *jsonNode) (string, error) {
+	switch n.kind {
+	case "string":
+		var s string
+		json.Unmarshal([]byte(n.raw), &s)
+		return tomlString(s), nil
+	case "number", "boolean":
+		return n.raw, nil
+	case "array":
+		var items []string
+		for _, item := range n.items {
+			s, err := tomlInline(item)
+			if err != nil {
+				return "", err
+			}
+			items = append(items, s)
+		}
+		return "[" + strings.Join(items, ", ") + "]", nil
+	case "object":
+		var fields []string
+		for _, f := range n.fields {
+			if f.value.kind == "null" {
+				continue
+			}
+			s, err := tomlInline(f.value)
+			if err != nil {
+				return "", err
+			}
+			fields = append(fields, tomlKeyString(f.key)+" = "+s)
+		}
+		if len(fields) == 0 {
+			return "{}", nil
+		}
+		return "{ " + strings.Join(fields, ", ") + " }", nil
+	}
+	return "", fmt.Errorf("null can't be written in TOML")
+}
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+func tomlKeyString(key string) string {
+	if bareTOMLKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+func tomlHeaderString(path []string) string {
+	var parts []string
+	for _, key := range path {
+		parts = append(parts, tomlKeyString(key))
+	}
+	return strings.Join(parts, ".")
+}
+
+// tomlString prefers 'literal' strings, which take backslashes as is
+func tomlString(s string) string {
+	literal := !strings.Contains(s, "'")
+	for _, r := range s {
+		if (r < 0x20 && r != '\t') || r == 0x7f {
+			literal = false
+		}
+	}
+	if literal {
+		return "'" + s + "'"
+	}
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\b':
+			b.WriteString(`\b`)
+		case '\f':
+			b.WriteString(`\f`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&b, `\u%04X`, r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"linkrouter/internal/dialogs"
+	"linkrouter/internal/logger"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// RuleTrace statuses
+const (
+	TraceInvalid = "invalid"
+	// TraceDisabled rules had errors when the config was loaded
+	TraceDisabled = "disabled"
+	TraceNoMatch  = "no match"
+	TraceExcluded = "excluded"
+	TraceMatched  = "matched"
+	// TraceSkipped is set by the launcher when a matched rule can't be launched,
+	// e.g. because of recursion protection
+	TraceSkipped = "skipped"
+)
+
+// RuleTrace is the outcome of evaluating one rule for a link
+type RuleTrace struct {
+	Index int    `json:"index"`
+	Regex string `json:"regex"`
+	// File is the included file the rule comes from, see Rule.File
+	File   string `json:"file,omitempty"`
+	Status string `json:"status"`
+	// Exclusion that rejected the rule, when Status is TraceExcluded
+	Exclusion string   `json:"exclusion,omitempty"`
+	Groups    []string `json:"groups,omitempty"`
+	Error     string   `json:"error,omitempty"`
+	// OnFailure is the policy followed when a skipped rule failed, see Rule.OnFailure
+	OnFailure string `json:"onFailure,omitempty"`
+}
+
+// Explain evaluates rules in order and records the outcome of each,
+// stopping at the first match. It has no side effects.
+func (c *Config) Explain(link *Link) []RuleTrace {
+	return c.ExplainFrom(link, 0)
+}
+
+// ExplainFrom is Explain starting at rule start, for a rule that failed with
+// onFailure nextRule
+func (c *Config) ExplainFrom(link *Link, start int) []RuleTrace {
+	raw := newMatchTarget(link.Raw)
+	decoded := newMatchTarget(link.Decoded)
+	var trace []RuleTrace
+	for i, cr := range c.compiledRules() {
+		if i < start {
+			continue
+		}
+		rule := &c.Rules[i]
+		target := decoded
+		if rule.MatchesRaw() {
+			target = raw
+		}
+		t := RuleTrace{Index: i, Regex: rule.Regex, File: rule.File, Status: TraceNoMatch}
+		if rule.disabled != "" {
+			t.Status = TraceDisabled
+			t.Error = rule.disabled
+			trace = append(trace, t)
+			continue
+		}
+		err := rule.validateGlobs()
+		var matches []string
+		excludedBy := -1
+		if err == nil {
+			matches, excludedBy, err = matchRule(rule, cr, target)
+		}
+		switch {
+		case err != nil:
+			t.Status = TraceInvalid
+			t.Error = err.Error()
+		case excludedBy >= 0:
+			t.Status = TraceExcluded
+			t.Exclusion = fmt.Sprintf("exclude[%d]: %s", excludedBy, rule.Exclude[excludedBy])
+		case len(matches) > 0:
+			t.Status = TraceMatched
+			t.Groups = matches
+		}
+		trace = append(trace, t)
+		if t.Status == TraceMatched {
+			break
+		}
+	}
+	return trace
+}
+
+// FromFile describes where a rule comes from for logs and reports,
+// nothing for rules of the config itself
+func FromFile(file string) string {
+	if file == "" {
+		return ""
+	}
+	return " from " + shortName(file)
+}
+
+// shortName is the base name of file, or the whole path for the config of
+// another layer, as they all have the same names
+func shortName(file string) string {
+	if slices.Contains(configNames, strings.ToLower(filepath.Base(file))) {
+		return file
+	}
+	return filepath.Base(file)
+}
+
+// Matched returns the winning entry of a trace, or nil
+func Matched(trace []RuleTrace) *RuleTrace {
+	if len(trace) > 0 && trace[len(trace)-1].Status == TraceMatched {
+		return &trace[len(trace)-1]
+	}
+	return nil
+}
+
+// ReportTrace writes the trace to the log. With popups broken rules are also shown in a dialog.
+func ReportTrace(trace []RuleTrace, popups bool) {
+	for _, t := range trace {
+		switch t.Status {
+		case TraceInvalid:
+			logger.Log("Invalid rule: " + t.Error)
+			logger.Log(fmt.Sprintf("Failed rule: regex=%q%s", t.Regex, FromFile(t.File)))
+			if popups {
+				dialogs.ShowError("invalid rule:\n" + t.Error)
+			}
+		case TraceExcluded:
+			logger.Log(fmt.Sprintf("Rule #%d regex=%q%s rejected by %s", t.Index, t.Regex, FromFile(t.File), t.Exclusion))
+		}
+	}
+	if Matched(trace) == nil {
+		logger.Log("Matched rule: None")
+	}
+}
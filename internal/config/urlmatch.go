@@ -0,0 +1,141 @@
+package config
+
+import (
+	"fmt"
+	urlpkg "net/url"
+	"path"
+	"strings"
+)
+
+// URLMatcher holds structured conditions evaluated on the parsed URL.
+// Empty fields are ignored, all set fields must match.
+type URLMatcher struct {
+	// exact scheme, case-insensitive
+	Scheme string `json:"scheme,omitempty"`
+	// "example.com" is exact, ".example.com" matches the domain and its subdomains,
+	// "*.example.com" is a glob. Always case-insensitive
+	Host string `json:"host,omitempty"`
+	Port string `json:"port,omitempty"`
+	// PathPrefix and PathGlob are matched against the unescaped path
+	PathPrefix string `json:"pathPrefix,omitempty"`
+	PathGlob   string `json:"pathGlob,omitempty"`
+	// query key must be present. non-empty value is matched as a glob
+	Query map[string]string `json:"query,omitempty"`
+}
+
+func (m *URLMatcher) IsEmpty() bool {
+	return m.Scheme == "" && m.Host == "" && m.Port == "" &&
+		m.PathPrefix == "" && m.PathGlob == "" && len(m.Query) == 0
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, "*?[")
+}
+
+// Validate checks glob syntax so broken patterns are reported instead of never matching
+func (m *URLMatcher) Validate() error {
+	if isGlob(m.Host) {
+		if _, err := path.Match(m.Host, ""); err != nil {
+			return fmt.Errorf("invalid host glob %q: %w", m.Host, err)
+		}
+	}
+	if _, err := path.Match(m.PathGlob, ""); err != nil {
+		return fmt.Errorf("invalid pathGlob %q: %w", m.PathGlob, err)
+	}
+	for key, value := range m.Query {
+		if _, err := path.Match(value, ""); err != nil {
+			return fmt.Errorf("invalid query glob %s=%q: %w", key, value, err)
+		}
+	}
+	return nil
+}
+
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	switch {
+	case strings.HasPrefix(pattern, "."):
+		return host == pattern[1:] || strings.HasSuffix(host, pattern)
+	case isGlob(pattern):
+		ok, _ := path.Match(pattern, host)
+		return ok
+	default:
+		return host == pattern
+	}
+}
+
+// default ports of schemes, for links that don't name theirs
+var defaultPorts = map[string]string{"http": "80", "https": "443", "ftp": "21"}
+
+// urlPort returns the port of u, the scheme's default when it has none
+func urlPort(u *urlpkg.URL) string {
+	if port := u.Port(); port != "" {
+		return port
+	}
+	return defaultPorts[strings.ToLower(u.Scheme)]
+}
+
+func (m *URLMatcher) Match(u *urlpkg.URL) bool {
+	if u == nil {
+		return false
+	}
+	if m.Scheme != "" && !strings.EqualFold(m.Scheme, u.Scheme) {
+		return false
+	}
+	if m.Host != "" && !matchHost(m.Host, u.Hostname()) {
+		return false
+	}
+	if m.Port != "" && m.Port != urlPort(u) {
+		return false
+	}
+	if m.PathPrefix != "" && !strings.HasPrefix(u.Path, m.PathPrefix) {
+		return false
+	}
+	if m.PathGlob != "" {
+		if ok, _ := path.Match(m.PathGlob, u.Path); !ok {
+			return false
+		}
+	}
+	if len(m.Query) > 0 {
+		query := u.Query()
+		for key, pattern := range m.Query {
+			values, ok := query[key]
+			if !ok {
+				return false
+			}
+			if pattern == "" {
+				continue
+			}
+			found := false
+			for _, v := range values {
+				if ok, _ := path.Match(pattern, v); ok {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// matchTarget is the URL being routed, parsed at most once
+type matchTarget struct {
+	url    string
+	parsed *urlpkg.URL
+	done   bool
+}
+
+func newMatchTarget(url string) *matchTarget {
+	return &matchTarget{url: url}
+}
+
+func (t *matchTarget) URL() *urlpkg.URL {
+	if !t.done {
+		t.parsed, _ = urlpkg.Parse(t.url)
+		t.done = true
+	}
+	return t.parsed
+}
@@ -0,0 +1,36 @@
+package config
+
+import (
+	urlpkg "net/url"
+	"testing"
+)
+
+func TestURLMatcherPort(t *testing.T) {
+	tests := []struct {
+		port, url string
+		want      bool
+	}{
+		{"443", "https://example.com/", true},
+		{"443", "HTTPS://example.com/", true},
+		{"443", "https://example.com:443/", true},
+		{"443", "https://example.com:8443/", false},
+		{"443", "http://example.com/", false},
+		{"80", "http://example.com/a", true},
+		{"80", "https://example.com/", false},
+		{"21", "ftp://example.com/file", true},
+		{"8080", "http://example.com:8080/", true},
+		{"8080", "http://example.com/", false},
+		{"22", "ssh://example.com/", false},
+		{"", "ssh://example.com/", true},
+	}
+	for _, tt := range tests {
+		u, err := urlpkg.Parse(tt.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := URLMatcher{Port: tt.port}
+		if got := m.Match(u); got != tt.want {
+			t.Errorf("port %q on %s = %v, want %v", tt.port, tt.url, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"linkrouter/internal/dialogs"
+	"linkrouter/internal/logger"
+	"linkrouter/internal/template"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// Problem severities. Errors disable the rule they are found in, or the
+// setting for global ones; warnings are only reported.
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// Problem is an issue found in the config file while loading
+type Problem struct {
+	// Path is the JSON path, e.g. rules[3].regex
+	Path string `json:"path"`
+	// File is the included file the problem is in, empty for the config itself
+	File string `json:"file,omitempty"`
+	// Rule is the index of the rule the problem is in, or -1
+	Rule     int    `json:"rule"`
+	Line     int    `json:"line,omitempty"`
+	Column   int    `json:"column,omitempty"`
+	Severity string `json:"severity"`
+	Message  string `json:"message"`
+}
+
+func (p Problem) String() string {
+	where := p.Path
+	if where == "" {
+		where = "config"
+	}
+	if p.Line > 0 {
+		where = fmt.Sprintf("%d:%d %s", p.Line, p.Column, where)
+	}
+	if p.File != "" {
+		where = shortName(p.File) + " " + where
+	}
+	return fmt.Sprintf("%s: %s", where, p.Message)
+}
+
+func newProblem(data []byte, path string, node *jsonNode, severity, msg string) Problem {
+	offset := -1
+	if node != nil {
+		offset = node.offset
+	}
+	return newProblemAt(data, path, offset, severity, msg)
+}
+
+func newProblemAt(data []byte, path string, offset int, severity, msg string) Problem {
+	p := Problem{Path: path, Rule: -1, Severity: severity, Message: msg}
+	if offset >= 0 {
+		p.Line, p.Column = position(data, offset)
+	}
+	var rule int
+	if _, err := fmt.Sscanf(path, "rules[%d]", &rule); err == nil {
+		p.Rule = rule
+	}
+	return p
+}
+
+func hasErrors(problems []Problem) bool {
+	for _, p := range problems {
+		if p.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeConfig decodes as much of the config as possible. A value of the wrong
+// type only loses itself, or its rule, instead of the whole file; the schema
+// check reports it.
+func decodeConfig(data []byte) (*Config, error) {
+	var cfg Config
+	err := json.Unmarshal(data, &cfg)
+	if err == nil {
+		return &cfg, nil
+	}
+	var doc map[string]json.RawMessage
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	cfg = Config{extra: unknownKeys(data, reflect.TypeOf(cfg))}
+	decodeFields(doc, reflect.ValueOf(&cfg).Elem())
+	return &cfg, nil
+}
+
+// decodeFields decodes the members of a JSON object into the fields of struct
+// v they belong to, each on its own, see decodeLenient
+func decodeFields(members map[string]json.RawMessage, v reflect.Value) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "" || name == "-" || !f.IsExported() {
+			continue
+		}
+		if raw, ok := members[name]; ok {
+			decodeLenient(raw, v.Field(i))
+		}
+	}
+}
+
+// decodeLenient decodes raw into v. Lists and maps are decoded an element at
+// a time and structs a field at a time, so that a value of the wrong type only
+// loses itself. Types with their own UnmarshalJSON, such as Rule, keep what
+// json.Unmarshal gets from them.
+func decodeLenient(raw json.RawMessage, v reflect.Value) {
+	err := json.Unmarshal(raw, v.Addr().Interface())
+	if err == nil {
+		return
+	}
+	if _, ok := v.Addr().Interface().(json.Unmarshaler); ok {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), len(items), len(items))
+		for i, item := range items {
+			decodeLenient(item, s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Map:
+		var items map[string]json.RawMessage
+		if json.Unmarshal(raw, &items) != nil || v.Type().Key().Kind() != reflect.String {
+			return
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(items))
+		for key, item := range items {
+			value := reflect.New(v.Type().Elem()).Elem()
+			decodeLenient(item, value)
+			m.SetMapIndex(reflect.ValueOf(key).Convert(v.Type().Key()), value)
+		}
+		v.Set(m)
+	case reflect.Struct:
+		var members map[string]json.RawMessage
+		if json.Unmarshal(raw, &members) == nil {
+			v.SetZero()
+			decodeFields(members, v)
+		}
+	}
+}
+
+// validateConfig checks the document against the schema, then every rule for
+// problems that would otherwise only show up when a link is routed.
+// Rules with errors are disabled for this session. file is set for included
+// files, they are checked against the include definition of the schema.
+func validateConfig(data []byte, tree *jsonNode, cfg *Config, file string) []Problem {
+	v := newSchemaValidator(data)
+	if file == "" {
+		v.check(v.root, tree, "")
+	} else {
+		v.check(v.resolve("#/definitions/include"), tree, "")
+	}
+	if cfg.SchemaVersion > ConfigVersion {
+		v.add("schemaVersion", tree.field("schemaVersion"), SeverityWarning,
+			"config version %d is newer than %d, settings this LinkRouter doesn't know are kept but have no effect",
+			cfg.SchemaVersion, ConfigVersion)
+	}
+
+	add := func(path string, node *jsonNode, format string, args ...any) {
+		v.add(path, node, SeverityError, format, args...)
+	}
+
+	checkRule := func(rule *Rule, path string, node *jsonNode) {
+		var names []string
+		if re, err := regexp.Compile(rule.Regex); err != nil {
+			add(path+".regex", node.field("regex"), "invalid regex: %s", err)
+		} else {
+			names = re.SubexpNames()
+		}
+		if err := rule.URLMatcher.Validate(); err != nil {
+			add(path, node, "%s", err)
+		}
+		for j, ex := range rule.Exclude {
+			exPath := fmt.Sprintf("%s.exclude[%d]", path, j)
+			exNode := node.field("exclude").item(j)
+			if _, err := regexp.Compile(ex.Regex); err != nil {
+				add(exPath, exNode, "invalid regex: %s", err)
+			}
+			if err := ex.URLMatcher.Validate(); err != nil {
+				add(exPath, exNode, "%s", err)
+			}
+		}
+
+		if rule.App == "" && strings.TrimSpace(rule.Program) == "" && len(rule.Actions) == 0 {
+			add(path+".program", node.field("program"), "program is empty")
+		}
+
+		if len(rule.Args) > 0 {
+			for j, arg := range rule.Args {
+				argPath := fmt.Sprintf("%s.args[%d]", path, j)
+				checkTemplate(arg, names, func(format string, args ...any) {
+					add(argPath, node.field("args").item(j), format, args...)
+				})
+			}
+		} else {
+			checkTemplate(rule.Arguments, names, func(format string, args ...any) {
+				add(path+".arguments", node.field("arguments"), format, args...)
+			})
+		}
+		checkLaunchValues(rule.WorkingDir, rule.Env, names, path, "workingDir", "env", node, add)
+
+		for j := range rule.Actions {
+			checkAction(rule, j, names, fmt.Sprintf("%s.actions[%d]", path, j), node.field("actions").item(j), add)
+		}
+	}
+	rules := tree.field("rules")
+	for i := range cfg.Rules {
+		checkRule(&cfg.Rules[i], fmt.Sprintf("rules[%d]", i), rules.item(i))
+	}
+	for _, name := range cfg.ProfileNames() {
+		node := tree.field("profiles").field(name)
+		rules := cfg.Profiles[name].Rules
+		for i := range rules {
+			checkRule(&rules[i], fmt.Sprintf("profiles.%s.rules[%d]", name, i), node.field("rules").item(i))
+		}
+	}
+
+	for _, name := range cfg.AppNames() {
+		app := cfg.Apps[name]
+		node := tree.field("apps").field(name)
+		if strings.TrimSpace(app.Program) == "" {
+			add("apps."+name+".program", node.field("program"), "program is empty")
+		}
+		// named groups depend on the rule, only the syntax is checked
+		if _, err := template.Parse(app.BaseArgs); err != nil {
+			add("apps."+name+".baseArgs", node.field("baseArgs"), "%s", err)
+		}
+	}
+
+	checkTemplate(cfg.Global.FallbackBrowserArgs, nil, func(format string, args ...any) {
+		add("global.fallbackBrowserArgs", tree.field("global").field("fallbackBrowserArgs"), format, args...)
+	})
+	for i, f := range cfg.Global.Fallbacks {
+		path := fmt.Sprintf("global.fallbacks[%d]", i)
+		node := tree.field("global").field("fallbacks").item(i)
+		targets := 0
+		for _, set := range []bool{f.App != "", strings.TrimSpace(f.Program) != "", f.SystemDefault} {
+			if set {
+				targets++
+			}
+		}
+		switch {
+		case targets == 0:
+			add(path, node, "needs a program, an app or systemDefault")
+		case targets > 1:
+			add(path, node, "set only one of program, app and systemDefault")
+		}
+		if len(f.Args) > 0 {
+			for j, arg := range f.Args {
+				checkTemplate(arg, nil, func(format string, args ...any) {
+					add(fmt.Sprintf("%s.args[%d]", path, j), node.field("args").item(j), format, args...)
+				})
+			}
+		} else {
+			checkTemplate(f.Arguments, nil, func(format string, args ...any) {
+				add(path+".arguments", node.field("arguments"), format, args...)
+			})
+		}
+	}
+	checkLaunchValues(cfg.Global.FallbackWorkingDir, cfg.Global.FallbackEnv, nil, "global",
+		"fallbackWorkingDir", "fallbackEnv", tree.field("global"), add)
+
+	for i := range v.problems {
+		v.problems[i].File = file
+	}
+	for _, p := range v.problems {
+		if p.Severity != SeverityError {
+			continue
+		}
+		switch {
+		case p.Rule >= 0 && p.Rule < len(cfg.Rules):
+			if cfg.Rules[p.Rule].disabled == "" {
+				cfg.Rules[p.Rule].disabled = p.String()
+			}
+		case strings.HasPrefix(p.Path, "profiles."):
+			// the rules slice is shared with the map's copy of the profile
+			if name, i, ok := profileRule(p.Path); ok && i < len(cfg.Profiles[name].Rules) {
+				if rule := &cfg.Profiles[name].Rules[i]; rule.disabled == "" {
+					rule.disabled = p.String()
+				}
+			}
+		case p.Path == "global.fallbackBrowserArgs":
+			cfg.Global.FallbackBrowserArgs = ""
+		}
+	}
+	return v.problems
+}
+
+// profileRule returns the profile and rule index of a problem path such as
+// profiles.work.rules[2].regex
+func profileRule(path string) (name string, rule int, ok bool) {
+	path = strings.TrimPrefix(path, "profiles.")
+	i := strings.LastIndex(path, ".rules[")
+	if i < 0 {
+		return "", 0, false
+	}
+	if _, err := fmt.Sscanf(path[i+1:], "rules[%d]", &rule); err != nil {
+		return "", 0, false
+	}
+	return path[:i], rule, true
+}
+
+// checkAction reports action j of rule that can't run and its broken templates
+func checkAction(rule *Rule, j int, groupNames []string, path string, node *jsonNode,
+	add func(path string, node *jsonNode, format string, args ...any)) {
+	a := &rule.Actions[j]
+	check := func(key, src string) {
+		checkTemplate(src, groupNames, func(format string, args ...any) {
+			add(path+"."+key, node.field(key), format, args...)
+		})
+	}
+	switch a.Kind() {
+	case ActionLaunch:
+		if !a.hasTarget() && rule.App == "" && strings.TrimSpace(rule.Program) == "" {
+			add(path, node, "launch needs a program or app, the rule has none")
+		}
+		for k, arg := range a.Args {
+			checkTemplate(arg, groupNames, func(format string, args ...any) {
+				add(fmt.Sprintf("%s.args[%d]", path, k), node.field("args").item(k), format, args...)
+			})
+		}
+		check("arguments", a.Arguments)
+		checkLaunchValues(a.WorkingDir, a.Env, groupNames, path, "workingDir", "env", node, add)
+	case ActionAppendToFile:
+		if strings.TrimSpace(a.File) == "" {
+			add(path+".file", node.field("file"), "file is empty")
+		}
+		check("file", a.File)
+		check("line", a.Line)
+	case ActionCopyToClipboard, ActionNotify:
+		check("text", a.Text)
+		check("title", a.Title)
+	case ActionBlock:
+		check("reason", a.Reason)
+	}
+}
+
+// checkLaunchValues checks the placeholders of a working directory and
+// environment, found under keys dirKey and envKey of node
+func checkLaunchValues(workingDir string, env map[string]string, groupNames []string, path, dirKey, envKey string,
+	node *jsonNode, add func(path string, node *jsonNode, format string, args ...any)) {
+	checkTemplate(workingDir, groupNames, func(format string, args ...any) {
+		add(path+"."+dirKey, node.field(dirKey), format, args...)
+	})
+	for _, name := range sortedKeys(env) {
+		checkTemplate(env[name], groupNames, func(format string, args ...any) {
+			add(path+"."+envKey+"."+name, node.field(envKey).field(name), format, args...)
+		})
+	}
+}
+
+// checkTemplate reports parse errors and named placeholders that are
+// neither URL accessors nor groups of the regex
+func checkTemplate(src string, groupNames []string, report func(format string, args ...any)) {
+	t, err := template.Parse(src)
+	if err != nil {
+		report("%s", err)
+		return
+	}
+	for _, ref := range t.Refs() {
+		// var. and env. references are expanded before, see Config.ExpandTemplate
+		if strings.HasPrefix(ref.Name, "var.") || strings.HasPrefix(ref.Name, "env.") {
+			continue
+		}
+		if ref.Group < 0 && !strings.HasPrefix(ref.Name, "URL") && ref.Name != "PROFILE" && !slices.Contains(groupNames, ref.Name) {
+			report("unknown placeholder ${%s}", ref.Name)
+		}
+	}
+}
+
+// problemsShown makes sure the dialog pops up once per process,
+// LoadConfig may run several times
+var problemsShown bool
+
+// maximum problems listed in the dialog, the log has all of them
+const maxDialogProblems = 10
+
+// showNewerVersion tells whether a config of version is newer than this
+// LinkRouter and hasn't been pointed out yet. Every link is a new process, so
+// the version is remembered in State to tell it only once.
+func showNewerVersion(version int) bool {
+	state := LoadState()
+	if version <= ConfigVersion {
+		if state.NewerVersionShown != 0 {
+			state.NewerVersionShown = 0
+			state.Save()
+		}
+		return false
+	}
+	if state.NewerVersionShown == version {
+		return false
+	}
+	state.NewerVersionShown = version
+	if err := state.Save(); err != nil {
+		logger.Log("Error: can't save state: " + err.Error())
+	}
+	return true
+}
+
+// reportProblems logs every problem and shows errors in a single dialog,
+// along with a warning the first time the config is newer than this build
+func reportProblems(configPath string, cfg *Config) {
+	problems := cfg.Problems
+	for _, p := range problems {
+		logger.Log(fmt.Sprintf("Config %s: %s", p.Severity, p))
+	}
+	newer := !problemsShown && showNewerVersion(cfg.SchemaVersion)
+	if problemsShown || !(newer || hasErrors(problems)) {
+		return
+	}
+	problemsShown = true
+
+	var msg []string
+	if newer {
+		msg = append(msg, fmt.Sprintf("%s was written for a newer LinkRouter (config version %d, this one supports %d).\n"+
+			"Settings this version doesn't know are kept in the file but have no effect.", configPath, cfg.SchemaVersion, ConfigVersion))
+	}
+
+	var lines []string
+	errors := 0
+	for _, p := range problems {
+		if p.Severity != SeverityError {
+			continue
+		}
+		errors++
+		if len(lines) < maxDialogProblems {
+			lines = append(lines, p.String())
+		}
+	}
+	if errors > len(lines) {
+		lines = append(lines, fmt.Sprintf("...and %d more", errors-len(lines)))
+	}
+	if errors > 0 {
+		msg = append(msg, fmt.Sprintf("%s has %d error(s), broken rules are disabled:\n\n%s",
+			configPath, errors, strings.Join(lines, "\n")))
+	}
+	dialogs.ShowError(strings.Join(msg, "\n\n"))
+}
@@ -0,0 +1,124 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDecodeConfigKeepsSectionsAfterTypeError(t *testing.T) {
+	data := []byte(`{
+		"schemaVersion": 1,
+		"global": {"fallbackBrowserPath": "firefox.exe", "interactiveMode": "yes"},
+		"rules": [
+			{"regex": "^https://a/", "program": "a.exe", "args": "x"},
+			{"regex": "^https://b/", "program": "b.exe"}
+		],
+		"variables": {"home": "C:\\Users\\me", "bad": 1},
+		"apps": {"chrome": {"program": "chrome.exe", "baseArgs": 2}},
+		"profiles": {"work": {"disable": ["b"], "rules": [{"regex": "^https://c/", "args": 3}]}},
+		"annotation": "kept"
+	}`)
+	cfg, err := decodeConfig(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.SchemaVersion != 1 {
+		t.Errorf("schemaVersion = %d, want 1", cfg.SchemaVersion)
+	}
+	if cfg.Global.FallbackBrowserPath != "firefox.exe" {
+		t.Errorf("global.fallbackBrowserPath = %q, want firefox.exe", cfg.Global.FallbackBrowserPath)
+	}
+	if len(cfg.Rules) != 2 || cfg.Rules[0].Program != "a.exe" || cfg.Rules[1].Program != "b.exe" {
+		t.Errorf("rules = %+v, want both rules with their programs", cfg.Rules)
+	}
+	if cfg.Variables["home"] != `C:\Users\me` {
+		t.Errorf("variables = %v, want home kept", cfg.Variables)
+	}
+	if cfg.Apps["chrome"].Program != "chrome.exe" {
+		t.Errorf("apps = %v, want chrome kept", cfg.Apps)
+	}
+	work, ok := cfg.Profiles["work"]
+	if !ok || len(work.Disable) != 1 || len(work.Rules) != 1 || work.Rules[0].Regex != "^https://c/" {
+		t.Errorf("profiles = %+v, want work with its rule and disable list", cfg.Profiles)
+	}
+	if _, ok := cfg.extra["annotation"]; !ok {
+		t.Errorf("extra = %v, want the unknown key kept", cfg.extra)
+	}
+}
+
+func TestDecodeConfigRejectsNonObject(t *testing.T) {
+	if _, err := decodeConfig([]byte(`[1, 2]`)); err == nil {
+		t.Error("decodeConfig of an array succeeded, want an error")
+	}
+}
+
+func TestBrokenProfileRulesAreDisabled(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "linkrouter.json")
+	data := `{
+		"rules": [{"regex": "^https://a/", "program": "a.exe"}],
+		"profiles": {"work.laptop": {"rules": [{"regex": "(", "program": "b.exe"}, {"regex": "^https://c/", "program": "c.exe"}]}}
+	}`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := ReadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := cfg.Profiles["work.laptop"].Rules
+	if rules[0].disabled == "" || rules[1].disabled != "" {
+		t.Errorf("profile rules disabled = %q, %q, want only the broken one", rules[0].disabled, rules[1].disabled)
+	}
+
+	if err := cfg.ApplyProfile("work.laptop"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ActiveProfile = "" })
+	if cfg.Rules[0].disabled == "" || cfg.Rules[1].disabled != "" || cfg.Rules[2].disabled != "" {
+		t.Errorf("rules after ApplyProfile disabled = %q, %q, %q, want only the first",
+			cfg.Rules[0].disabled, cfg.Rules[1].disabled, cfg.Rules[2].disabled)
+	}
+}
+
+func TestProfileRule(t *testing.T) {
+	tests := []struct {
+		path string
+		name string
+		rule int
+		ok   bool
+	}{
+		{"profiles.work.rules[2]", "work", 2, true},
+		{"profiles.work.rules[0].regex", "work", 0, true},
+		{"profiles.a.b.rules[1].args[0]", "a.b", 1, true},
+		{"profiles.work.global.logPath", "", 0, false},
+		{"profiles.work.disable[0]", "", 0, false},
+	}
+	for _, tt := range tests {
+		name, rule, ok := profileRule(tt.path)
+		if name != tt.name || rule != tt.rule || ok != tt.ok {
+			t.Errorf("profileRule(%q) = %q, %d, %v, want %q, %d, %v", tt.path, name, rule, ok, tt.name, tt.rule, tt.ok)
+		}
+	}
+}
+
+func TestShowNewerVersionOnce(t *testing.T) {
+	t.Setenv("LOCALAPPDATA", t.TempDir())
+	steps := []struct {
+		version int
+		want    bool
+	}{
+		{ConfigVersion, false},
+		{ConfigVersion + 1, true},
+		{ConfigVersion + 1, false},
+		{ConfigVersion + 2, true},
+		{ConfigVersion, false},
+		{ConfigVersion + 2, true},
+	}
+	for i, step := range steps {
+		if got := showNewerVersion(step.version); got != step.want {
+			t.Errorf("step %d: showNewerVersion(%d) = %v, want %v", i, step.version, got, step.want)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// varRef finds references expanded in config values:
+//
+//	%NAME%        environment variable, left as is when it isn't set
+//	${env.NAME}   environment variable
+//	${var.name}   entry of the variables section
+//	${NAME}       environment variable, only in paths, as in argument
+//	              templates it is a named capture group
+//	$$            literal $, left for argument templates
+var varRef = regexp.MustCompile(`%([_a-zA-Z][_a-zA-Z0-9\-]*)%|\$\$|\$\{(env|var)\.([^}]+)\}|\$\{([^}]+)\}`)
+
+// expand replaces references in s. paths says whether ${NAME} is an environment
+// variable. stack holds the variables being expanded, to catch cycles.
+func (c *Config) expand(s string, paths bool, stack []string) (string, error) {
+	if !strings.ContainsAny(s, "%$") {
+		return s, nil
+	}
+	var err error
+	out := varRef.ReplaceAllStringFunc(s, func(ref string) string {
+		m := varRef.FindStringSubmatch(ref)
+		switch {
+		case err != nil || m[0] == "$$":
+			return ref
+		case m[1] != "":
+			if value, ok := os.LookupEnv(m[1]); ok {
+				return value
+			}
+			return ref
+		case m[2] == "env":
+			return os.Getenv(m[3])
+		case m[2] == "var":
+			var value string
+			value, err = c.variable(m[3], paths, stack)
+			return value
+		case paths:
+			return os.Getenv(m[4])
+		}
+		return ref
+	})
+	return out, err
+}
+
+// variable returns the expanded value of variable name. Its references are
+// expanded as those of the value it ends up in.
+func (c *Config) variable(name string, paths bool, stack []string) (string, error) {
+	if i := slices.Index(stack, name); i >= 0 {
+		return "", fmt.Errorf("variable cycle: %s -> %s", strings.Join(stack[i:], " -> "), name)
+	}
+	value, ok := c.Variables[name]
+	if !ok {
+		return "", fmt.Errorf("unknown variable %q", name)
+	}
+	return c.expand(value, paths, append(stack, name))
+}
+
+// ExpandPath expands variables and environment variables in a program or
+// file path
+func (c *Config) ExpandPath(path string) (string, error) {
+	return c.expand(path, true, nil)
+}
+
+// ExpandTemplate expands variables and environment variables in an argument
+// template, placeholders are left to the template engine
+func (c *Config) ExpandTemplate(src string) (string, error) {
+	return c.expand(src, false, nil)
+}
+
+// checkReferences reports variables that can't be expanded, and settings and
+// rules referring to them or to unknown apps. It runs once every file is
+// merged, as any of them may use variables and apps of another. Rules with
+// such errors are disabled.
+func (c *Config) checkReferences() {
+	for _, name := range sortedKeys(c.Variables) {
+		if _, err := c.variable(name, false, nil); err != nil {
+			c.Problems = append(c.Problems, Problem{Path: "variables." + name, Rule: -1, Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	if c.Global.FallbackBrowserPath != "" {
+		f := NewFallback(c.Global.FallbackBrowserPath, c.Global.FallbackBrowserArgs)
+		if _, err := c.FallbackLaunch(&f); err != nil {
+			c.Problems = append(c.Problems, Problem{Path: "global.fallbackBrowserPath", Rule: -1, Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	for i, f := range c.Global.Fallbacks {
+		// the system default browser is looked up when a link needs it
+		f.SystemDefault = false
+		if _, err := c.FallbackLaunch(&f); err != nil {
+			c.Problems = append(c.Problems, Problem{Path: fmt.Sprintf("global.fallbacks[%d]", i), Rule: -1, Severity: SeverityError, Message: err.Error()})
+		}
+	}
+	if _, err := c.ExpandPath(c.Global.LogPath); err != nil {
+		c.Problems = append(c.Problems, Problem{Path: "global.logPath", Rule: -1, Severity: SeverityError, Message: err.Error()})
+	}
+
+	index := map[string]int{}
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		// path within the file the rule comes from
+		n := index[rule.File]
+		index[rule.File]++
+		_, err := c.RuleLaunch(rule)
+		if err == nil {
+			err = c.checkActions(rule)
+		}
+		if err != nil {
+			p := Problem{Path: fmt.Sprintf("rules[%d]", n), File: rule.File, Rule: i, Severity: SeverityError, Message: err.Error()}
+			c.Problems = append(c.Problems, p)
+			if rule.disabled == "" {
+				rule.disabled = p.String()
+			}
+		}
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
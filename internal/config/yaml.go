@@ -0,0 +1,263 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+var yamlFormat = &configFormat{
+	name:     "YAML",
+	toJSON:   yamlToJSON,
+	fromJSON: jsonToYAML,
+}
+
+func yamlToJSON(data []byte) ([]byte, func(string) (int, int), error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, nil, err
+	}
+	var out bytes.Buffer
+	if err := writeYAMLAsJSON(&out, &root); err != nil {
+		return nil, nil, err
+	}
+	locate := func(path string) (int, int) {
+		n := locateYAML(&root, splitPath(path))
+		if n == nil {
+			return 0, 0
+		}
+		return n.Line, n.Column
+	}
+	return out.Bytes(), locate, nil
+}
+
+// writeYAMLAsJSON converts keeping the key order, so converting back and
+// forth doesn't shuffle the config
+func writeYAMLAsJSON(out *bytes.Buffer, n *yaml.Node) error {
+	switch n.Kind {
+	case 0:
+		out.WriteString("{}")
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			out.WriteString("{}")
+			return nil
+		}
+		return writeYAMLAsJSON(out, n.Content[0])
+	case yaml.AliasNode:
+		return writeYAMLAsJSON(out, n.Alias)
+	case yaml.MappingNode:
+		out.WriteByte('{')
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i]
+			if key.Kind != yaml.ScalarNode || key.Tag == "!!merge" {
+				return fmt.Errorf("line %d: only plain keys are supported", key.Line)
+			}
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			name, _ := json.Marshal(key.Value)
+			out.Write(name)
+			out.WriteByte(':')
+			if err := writeYAMLAsJSON(out, n.Content[i+1]); err != nil {
+				return err
+			}
+		}
+		out.WriteByte('}')
+	case yaml.SequenceNode:
+		out.WriteByte('[')
+		for i, item := range n.Content {
+			if i > 0 {
+				out.WriteByte(',')
+			}
+			if err := writeYAMLAsJSON(out, item); err != nil {
+				return err
+			}
+		}
+		out.WriteByte(']')
+	case yaml.ScalarNode:
+		var v any
+		if err := n.Decode(&v); err != nil {
+			return err
+		}
+		data, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", n.Line, err)
+		}
+		out.Write(data)
+	}
+	return nil
+}
+
+// locateYAML returns the node at path, or the deepest one found on the way
+func locateYAML(n *yaml.Node, path []any) *yaml.Node {
+	if n.Kind == yaml.DocumentNode && len(n.Content) > 0 {
+		n = n.Content[0]
+	}
+	for _, seg := range path {
+		if n.Kind == yaml.AliasNode {
+			n = n.Alias
+		}
+		var next *yaml.Node
+		switch seg := seg.(type) {
+		case string:
+			if n.Kind == yaml.MappingNode {
+				for i := 0; i+1 < len(n.Content); i += 2 {
+					if n.Content[i].Value == seg {
+						next = n.Content[i+1]
+					}
+				}
+			}
+		case int:
+			if n.Kind == yaml.SequenceNode && seg < len(n.Content) {
+				next = n.Content[seg]
+			}
+		}
+		if next == nil {
+			break
+		}
+		n = next
+	}
+	return n
+}
+
+func jsonToYAML(doc, original []byte) ([]byte, error) {
+	tree, err := parseJSON(doc)
+	if err != nil {
+		return nil, err
+	}
+	root := buildYAML(tree)
+	if original != nil {
+		var old yaml.Node
+		if yaml.Unmarshal(original, &old) == nil && old.Kind == yaml.DocumentNode && len(old.Content) > 0 {
+			root = mergeYAML(old.Content[0], root)
+		}
+	}
+	var out bytes.Buffer
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(2)
+	if err := enc.Encode(&yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{root}}); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	return out.Bytes(), nil
+}
+
+func buildYAML(n *jsonNode) *yaml.Node {
+	switch n.kind {
+	case "object":
+		m := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, f := range n.fields {
+			m.Content = append(m.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: f.key},
+				buildYAML(f.value))
+		}
+		return m
+	case "array":
+		s := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range n.items {
+			s.Content = append(s.Content, buildYAML(item))
+		}
+		return s
+	case "string":
+		var value string
+		json.Unmarshal([]byte(n.raw), &value)
+		s := &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+		// single quotes need no backslash escaping, which is the point for regexes
+		if strings.Contains(value, `\`) && !strings.ContainsAny(value, "\n\r\t") {
+			s.Style = yaml.SingleQuotedStyle
+		}
+		return s
+	case "number":
+		tag := "!!int"
+		if strings.ContainsAny(n.raw, ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: n.raw}
+	case "boolean":
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: n.raw}
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}
+}
+
+// mergeYAML updates the original document with new values, keeping its
+// comments, key order and anchors where values didn't change
+func mergeYAML(old, n *yaml.Node) *yaml.Node {
+	if yamlCanonical(old) == yamlCanonical(n) {
+		return old
+	}
+	if old.Kind == yaml.AliasNode || old.Kind != n.Kind {
+		copyYAMLComments(n, old)
+		return n
+	}
+	merged := *old
+	switch n.Kind {
+	case yaml.ScalarNode:
+		merged.Value, merged.Tag = n.Value, n.Tag
+		if n.Style != 0 || old.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0 {
+			merged.Style = n.Style
+		}
+	case yaml.MappingNode:
+		newValues := map[string]*yaml.Node{}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			newValues[n.Content[i].Value] = n.Content[i+1]
+		}
+		done := map[string]bool{}
+		merged.Content = nil
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			key := old.Content[i].Value
+			value, ok := newValues[key]
+			if !ok || done[key] {
+				continue
+			}
+			done[key] = true
+			merged.Content = append(merged.Content, old.Content[i], mergeYAML(old.Content[i+1], value))
+		}
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			if !done[n.Content[i].Value] {
+				merged.Content = append(merged.Content, n.Content[i], n.Content[i+1])
+			}
+		}
+	case yaml.SequenceNode:
+		merged.Content = nil
+		for j, k := range matchYAMLItems(old.Content, n.Content) {
+			if k < 0 {
+				merged.Content = append(merged.Content, n.Content[j])
+			} else {
+				merged.Content = append(merged.Content, mergeYAML(old.Content[k], n.Content[j]))
+			}
+		}
+	}
+	return &merged
+}
+
+// matchYAMLItems pairs new sequence items with old ones, see pairItems
+func matchYAMLItems(old, items []*yaml.Node) []int {
+	var oldCanon, newCanon, oldKinds, newKinds []string
+	for _, item := range old {
+		oldCanon = append(oldCanon, yamlCanonical(item))
+		oldKinds = append(oldKinds, fmt.Sprint(item.Kind))
+	}
+	for _, item := range items {
+		newCanon = append(newCanon, yamlCanonical(item))
+		newKinds = append(newKinds, fmt.Sprint(item.Kind))
+	}
+	return pairItems(oldCanon, newCanon, oldKinds, newKinds)
+}
+
+func yamlCanonical(n *yaml.Node) string {
+	var out bytes.Buffer
+	if writeYAMLAsJSON(&out, n) != nil {
+		return ""
+	}
+	var v any
+	json.Unmarshal(out.Bytes(), &v)
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+func copyYAMLComments(dst, src *yaml.Node) {
+	dst.HeadComment, dst.LineComment, dst.FootComment = src.HeadComment, src.LineComment, src.FootComment
+}
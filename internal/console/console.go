@@ -0,0 +1,45 @@
+package console
+
+import (
+	"os"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modKernel32       = windows.NewLazySystemDLL("kernel32.dll")
+	procAttachConsole = modKernel32.NewProc("AttachConsole")
+)
+
+const attachParentProcess = ^uintptr(0) // ATTACH_PARENT_PROCESS = (DWORD)-1
+
+// Attach makes stdout usable in a binary built with -H windowsgui.
+// Redirected output (pipe or file) is kept as is, otherwise we attach
+// to the console of the parent process, if any.
+func Attach() {
+	if isRedirected(windows.STD_OUTPUT_HANDLE) {
+		return
+	}
+	ret, _, _ := procAttachConsole.Call(attachParentProcess)
+	if ret == 0 {
+		return
+	}
+	if out, err := os.OpenFile("CONOUT$", os.O_WRONLY, 0); err == nil {
+		os.Stdout = out
+		if !isRedirected(windows.STD_ERROR_HANDLE) {
+			os.Stderr = out
+		}
+	}
+}
+
+func isRedirected(stdHandle uint32) bool {
+	h, err := windows.GetStdHandle(stdHandle)
+	if err != nil || h == 0 || h == windows.InvalidHandle {
+		return false
+	}
+	t, err := windows.GetFileType(h)
+	if err != nil {
+		return false
+	}
+	return t == windows.FILE_TYPE_DISK || t == windows.FILE_TYPE_PIPE
+}
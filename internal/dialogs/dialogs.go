@@ -10,6 +10,11 @@ func ShowError(msg string) {
 	ShowMessageBox("LinkRouter Error", msg, 0x00000010) // MB_ICONERROR
 }
 
+// ShowInfo shows text with an information icon and waits until it is closed
+func ShowInfo(title, text string) {
+	ShowMessageBox(title, text, 0x00000040) // MB_ICONINFORMATION
+}
+
 func ShowMessageBox(title, text string, icon uint) int {
 	if globals.QuietMode {
 		return 0
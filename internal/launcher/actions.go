@@ -0,0 +1,215 @@
+package launcher
+
+import (
+	"errors"
+	"fmt"
+	"linkrouter/internal/config"
+	"linkrouter/internal/dialogs"
+	"linkrouter/internal/logger"
+	"linkrouter/internal/template"
+	"linkrouter/internal/utils"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Action statuses, see ActionResult
+const (
+	ActionDone    = "done"
+	ActionFailed  = "failed"
+	ActionSkipped = "skipped"
+	// ActionPlanned is an action a dry run would have run
+	ActionPlanned = "planned"
+)
+
+// ActionResult is what an action of the matched rule did
+type ActionResult struct {
+	// Rule is the index of the rule the action belongs to. Actions of a rule
+	// that failed with onFailure nextRule are kept, they may have run.
+	Rule  int    `json:"rule"`
+	Index int    `json:"index"`
+	Type  string `json:"type"`
+	// Detail is the text copied, shown or appended, or the reason of a block
+	Detail  string   `json:"detail,omitempty"`
+	Command *Command `json:"command,omitempty"`
+	Status  string   `json:"status"`
+	Error   string   `json:"error,omitempty"`
+	// Ignored errors come from actions with continueOnError
+	Ignored bool `json:"ignored,omitempty"`
+}
+
+// errBlocked stops the actions of a rule, the link goes nowhere
+var errBlocked = errors.New("blocked")
+
+// runActions runs the actions of rule in order. It stops at the first one that
+// fails without continueOnError and returns its error, the rest are skipped.
+// A block action stops them too and sets d.Blocked.
+func (d *Decision) runActions(cfg *config.Config, rule *config.Rule, link *config.Link, matches []string, dryRun bool) error {
+	var stop error
+	for i := range rule.Actions {
+		a := &rule.Actions[i]
+		r := ActionResult{Rule: d.RuleIndex, Index: i, Type: a.Kind()}
+		if stop != nil {
+			r.Status = ActionSkipped
+			d.Actions = append(d.Actions, r)
+			continue
+		}
+
+		err := runAction(cfg, rule, a, link, matches, dryRun, &r)
+		switch {
+		case errors.Is(err, errBlocked):
+			r.Status = ActionDone
+			d.Blocked = r.Detail
+			stop = err
+		case err != nil:
+			r.Status = ActionFailed
+			r.Error = err.Error()
+			r.Ignored = a.ContinueOnError
+			logger.Log(fmt.Sprintf("Error: action #%d %s: %s", i, r.Type, err))
+			if !a.ContinueOnError {
+				stop = fmt.Errorf("action #%d %s: %w", i, r.Type, err)
+			}
+		case dryRun:
+			r.Status = ActionPlanned
+		default:
+			r.Status = ActionDone
+		}
+		d.Actions = append(d.Actions, r)
+	}
+	if errors.Is(stop, errBlocked) {
+		return nil
+	}
+	return stop
+}
+
+// runAction runs a single action, or only fills r with what it would do
+func runAction(cfg *config.Config, rule *config.Rule, a *config.Action, link *config.Link, matches []string, dryRun bool, r *ActionResult) error {
+	a, err := cfg.ExpandAction(a)
+	if err != nil {
+		return err
+	}
+	ctx := TemplateContext(link, rule, matches)
+	orURL := func(s string) string {
+		if s == "" {
+			return "{URL}"
+		}
+		return s
+	}
+
+	switch a.Kind() {
+	case config.ActionOpenFallback:
+		if len(cfg.Fallbacks()) == 0 {
+			return errors.New("no fallback browser configured")
+		}
+		var failed []string
+		r.Command, failed, err = openFallback(cfg, link, dryRun)
+		if len(failed) > 0 && err == nil {
+			r.Detail = "after " + strings.Join(failed, "; ")
+		}
+		return err
+
+	case config.ActionLaunch:
+		l, err := cfg.ActionLaunch(rule, a)
+		if err == nil {
+			r.Command, err = BuildLaunch(l, ctx)
+		}
+		if err != nil {
+			return err
+		}
+		return start(r.Command, dryRun)
+
+	case config.ActionCopyToClipboard:
+		if r.Detail, err = expandValue(orURL(a.Text), ctx); err != nil || dryRun {
+			return err
+		}
+		logger.Log("Copying to clipboard: " + r.Detail)
+		return utils.CopyToClipboard(r.Detail)
+
+	case config.ActionAppendToFile:
+		var path, line string
+		if path, err = expandFilePath(a.File, ctx); err != nil {
+			return err
+		}
+		if line, err = expandValue(orURL(a.Line), ctx); err != nil {
+			return err
+		}
+		r.Detail = path + ": " + line
+		if dryRun {
+			return nil
+		}
+		logger.Log(fmt.Sprintf("Appending to %s: %s", path, line))
+		return appendLine(path, line)
+
+	case config.ActionNotify:
+		title := "LinkRouter"
+		if a.Title != "" {
+			if title, err = expandValue(a.Title, ctx); err != nil {
+				return err
+			}
+		}
+		if r.Detail, err = expandValue(orURL(a.Text), ctx); err != nil || dryRun {
+			return err
+		}
+		logger.Log(fmt.Sprintf("Notifying: %s: %s", title, r.Detail))
+		dialogs.ShowInfo(title, r.Detail)
+		return nil
+
+	case config.ActionBlock:
+		r.Detail = "blocked by rule"
+		if a.Reason != "" {
+			if r.Detail, err = expandValue(a.Reason, ctx); err != nil {
+				return err
+			}
+		}
+		logger.Log("Blocked: " + r.Detail)
+		if !dryRun {
+			dialogs.ShowMessageBox("LinkRouter", "Link blocked:\n"+r.Detail+"\n\n"+link.Original, 0x00000030) // MB_ICONWARNING
+		}
+		return errBlocked
+	}
+	return fmt.Errorf("unknown action type %q", a.Type)
+}
+
+// appendLine appends line to the file at path, relative to the executable
+// like logPath, creating it when needed
+// expandFilePath expands a file template. Text from the link can't leave the
+// directory the template names: values with separators, drive letters or ..
+// are refused, and the path must stay under the text before the first
+// placeholder.
+func expandFilePath(src string, ctx *template.Context) (string, error) {
+	tmpl, err := template.Parse(src)
+	if err != nil {
+		return "", err
+	}
+	for _, value := range tmpl.Values(ctx) {
+		if strings.ContainsAny(value, `/\:`) || strings.Contains(value, "..") {
+			return "", fmt.Errorf("%q can't be part of a file path", value)
+		}
+	}
+	path, err := expandValue(src, ctx)
+	if err != nil || len(tmpl.Refs()) == 0 {
+		return path, err
+	}
+	dir := filepath.Dir(tmpl.Prefix())
+	if rel, err := filepath.Rel(dir, filepath.Clean(path)); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is outside of %s", path, dir)
+	}
+	return path, nil
+}
+
+func appendLine(path string, line string) error {
+	if !filepath.IsAbs(path) {
+		exe, _ := os.Executable()
+		path = filepath.Join(filepath.Dir(exe), path)
+	}
+	os.MkdirAll(filepath.Dir(path), 0755)
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(strings.TrimRight(line, "\r\n") + "\r\n")
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
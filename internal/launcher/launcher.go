@@ -2,19 +2,22 @@ package launcher
 
 import (
 	"fmt"
+	"io"
 	"linkrouter/internal/config"
 	"linkrouter/internal/dialogs"
 	"linkrouter/internal/logger"
 	"linkrouter/internal/registry"
+	"linkrouter/internal/template"
 	"linkrouter/internal/utils"
-	urlpkg "net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"syscall"
+	"unicode"
 )
 
 func HandleNoArgs() {
@@ -51,6 +54,82 @@ func HandleNoArgs() {
 	os.Exit(0)
 }
 
+// ConvertConfig writes the current config to out, in the format of its extension.
+// Returns the process exit code.
+func ConvertConfig(out string, w io.Writer) int {
+	in := config.GetConfigPath()
+	if err := config.ConvertConfig(in, out); err != nil {
+		fmt.Fprintln(w, "Error: "+err.Error())
+		return 1
+	}
+	fmt.Fprintf(w, "Converted %s to %s\n", in, out)
+	return 0
+}
+
+// ResetFallbacks forgets which fallback browsers failed to start, see
+// config.FallbackOrder
+func ResetFallbacks(w io.Writer) int {
+	if err := config.ResetFallbacks(); err != nil {
+		fmt.Fprintln(w, "Error: "+err.Error())
+		return 1
+	}
+	fmt.Fprintln(w, "Fallback browsers are tried in config order again")
+	return 0
+}
+
+// MigrateConfig upgrades the config to the current schemaVersion and prints
+// the diff. With dryRun nothing is written.
+func MigrateConfig(dryRun bool, w io.Writer) int {
+	path := config.GetConfigPath()
+	res, err := config.Migrate(path, dryRun)
+	if err != nil {
+		fmt.Fprintln(w, "Error: "+err.Error())
+		return 1
+	}
+	switch {
+	case res.From > config.ConfigVersion:
+		fmt.Fprintf(w, "%s is version %d, newer than this LinkRouter supports (%d)\n", path, res.From, config.ConfigVersion)
+		return 0
+	case res.From == res.To:
+		fmt.Fprintf(w, "%s is up to date (version %d)\n", path, res.To)
+		return 0
+	case dryRun:
+		fmt.Fprintf(w, "Would upgrade %s from version %d to %d:\n", path, res.From, res.To)
+	default:
+		fmt.Fprintf(w, "Upgraded %s from version %d to %d, original saved as %s:\n", path, res.From, res.To, res.Backup)
+	}
+	for _, step := range res.Steps {
+		fmt.Fprintln(w, " - "+step)
+	}
+	fmt.Fprintln(w)
+	fmt.Fprint(w, res.Diff)
+	return 0
+}
+
+// SetProfile makes name the active profile, "" for none.
+// Returns the process exit code.
+func SetProfile(name string, w io.Writer) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Fprintln(w, "config error: "+err.Error())
+		return 1
+	}
+	if err := cfg.SetActiveProfile(name); err != nil {
+		fmt.Fprintln(w, "Error: "+err.Error())
+		if names := cfg.ProfileNames(); len(names) > 0 {
+			fmt.Fprintln(w, "Profiles: "+strings.Join(names, ", "))
+		}
+		return 1
+	}
+	if name == "" {
+		fmt.Fprintln(w, "No active profile")
+	} else {
+		fmt.Fprintln(w, "Active profile: "+name)
+	}
+	logger.Log(fmt.Sprintf("Active profile set to %q", name))
+	return 0
+}
+
 func EditConfig() {
 	cfg, _ := config.LoadConfig()
 	editor := cfg.Global.DefaultConfigEditor
@@ -86,12 +165,21 @@ func Help() {
 
 USAGE:
  linkrouter.exe [URL]	Handle a link
+ linkrouter.exe --resolve URL [--json]	Print routing decision, launch nothing
+ linkrouter.exe --explain URL [--json]	Same, with the outcome of every rule
+ linkrouter.exe --selftest [--json]	Run inline rule tests
+ linkrouter.exe --lint [--json]	Find broken and unreachable rules
+ linkrouter.exe --convert-config FILE	Convert config to .json, .yaml or .toml
+ linkrouter.exe --migrate [--dry-run]	Upgrade config to the current format, print the diff
+ linkrouter.exe --profile NAME	Switch to profile NAME, --profile= for none
+ linkrouter.exe --reset-fallbacks	Try fallback browsers in config order again
  linkrouter.exe --register	Register in system
  linkrouter.exe --unregister	Remove registration
  linkrouter.exe		Open default browser
 
 CONFIG:
  Config is autogenerated next to executable and is named linkrouter.json
+ linkrouter.yaml and linkrouter.toml are picked up as well
 
 EXAMPLE RULES:
  {
@@ -116,103 +204,26 @@ func IsCorrectURL(s string) bool {
 	return len(strings.TrimSpace(s)) > 1
 }
 
-func HandleURL(url string) {
-	from_extension := false
-	url = strings.TrimSpace(url)
-	cfg, err := config.LoadConfig()
-	if err != nil {
-		dialogs.ShowError("config error:\n" + err.Error())
-		return
-	}
-
-	logger.Log(fmt.Sprintf("Handling URL: %s", url))
-	if strings.HasPrefix(strings.ToLower(url), "linkrouter-ext://") {
-		from_extension = true
-		url = strings.TrimPrefix(url, "linkrouter-ext://")
-		logger.Log(fmt.Sprintf("Trimmed URL: %s", url))
-	}
-
-	if decoded, err := urlpkg.QueryUnescape(url); err == nil {
-		url = decoded
-	}
-
-	// windows appends trailing slash in this case
-	if from_extension && strings.HasSuffix(url, "/") {
-		url = url[:len(url)-1]
-	}
-
-	if rule, matches, ruleIndex := cfg.MatchRule(url); rule != nil {
-		logger.Log(fmt.Sprintf("Matched rule #%d: regex=%q", ruleIndex, rule.Regex))
-		logger.Log(fmt.Sprintf("Captured groups: %s", logger.FormatCaptureGroups(matches)))
-
-		expandedArgs := ExpandPlaceholders(rule.Arguments, matches)
-		err := LaunchApp(rule.Program, expandedArgs, url)
-		if err == nil {
-			return
-		} else {
-			dialogs.ShowError(fmt.Sprintf(
-				"failed to launch app\n%s:\n%s",
-				rule.Program,
-				err,
-			))
-		}
-	}
-
-	if cfg.Global.InteractiveMode {
-		exe, _ := os.Executable()
-		exeDir := filepath.Dir(exe)
-		guiPath := filepath.Join(exeDir, "linkrouter-gui.exe")
-
-		if _, err := os.Stat(guiPath); err == nil {
-			quotedGUI := strconv.Quote(guiPath)
-			guiArgs := `--interactive --url=` + strconv.Quote(url)
-			fullCmdLine := quotedGUI + " " + guiArgs
-
-			cmd := exec.Command(guiPath)
-			cmd.Path = guiPath
-			cmd.SysProcAttr = &syscall.SysProcAttr{
-				CmdLine: fullCmdLine,
-			}
-
-			err := cmd.Start()
-			if err == nil {
-				logger.Log("Interactive GUI launched successfully")
-				os.Exit(0)
-			} else {
-				logger.Log("Failed to launch GUI: " + err.Error())
-			}
-		}
-	}
-
-	if cfg.Global.FallbackBrowserPath != "" {
-		argsTemplate := cfg.Global.FallbackBrowserArgs
-		if argsTemplate == "" {
-			logger.Log("Arguments are empty appending {URL}")
-			argsTemplate = "{URL}"
-		}
-		err := LaunchApp(cfg.Global.FallbackBrowserPath, argsTemplate, url)
-		if err == nil {
-			return
-		} else {
-			logger.Log(fmt.Sprintf("Error: failed to launch fallback browser. %s", err))
-			dialogs.ShowError(fmt.Sprintf(
-				"failed to launch fallback browser:\n%s:\n%s",
-				cfg.Global.FallbackBrowserPath,
-				err))
+// hasControlChars reports NULs, newlines and other control characters,
+// which have no business in a link but can break a command line
+func hasControlChars(s string) bool {
+	for _, r := range s {
+		if unicode.IsControl(r) {
+			return true
 		}
-	} else {
-		errorText := "Error: no rule matched and no default browser configured"
-		logger.Log(errorText)
-		dialogs.ShowError(errorText)
 	}
+	return false
 }
 
-// in GO %VARS% are not expanded. so convert then to unix-style
-func expandPath(path string) string {
-	re := regexp.MustCompile(`%([_a-zA-Z][_a-zA-Z0-9\-]*)%`)
-	converted := re.ReplaceAllString(path, `$${$1}`)
-	ready_path := os.ExpandEnv(converted)
-	return ready_path
+// HandleURL routes url and returns the process exit code, see Decision.ExitCode
+func HandleURL(url string) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		dialogs.ShowError("config error:\n" + err.Error())
+		return 1
+	}
+	cfg.ApplyActiveProfile()
+	return Route(cfg, url, false).ExitCode()
 }
 
 func containsSupportedProtocol(argsLine string) bool {
@@ -222,7 +233,7 @@ func containsSupportedProtocol(argsLine string) bool {
 			logger.Log("Got empty protocol from SupportedProtocols. Skipping")
 			continue
 		}
-		pattern := `(^|[ \t])` + regexp.QuoteMeta(cleanProto) + `:`
+		pattern := `(^|[ \t"'])` + regexp.QuoteMeta(cleanProto) + `:`
 		if matched, _ := regexp.MatchString(pattern, argsLine); matched {
 			return true
 		}
@@ -234,34 +245,102 @@ func isExplorer(path string) bool {
 	return strings.EqualFold(filepath.Base(path), "explorer.exe")
 }
 
-func LaunchApp(programPath, argsTemplate, url string) error {
+// Command is a fully expanded program invocation
+type Command struct {
+	Program     string `json:"program"`
+	Arguments   string `json:"arguments"`
+	CommandLine string `json:"commandLine"`
+	// WorkingDir and Env come from the rule or its app, Env is added to the
+	// environment of LinkRouter
+	WorkingDir string            `json:"workingDir,omitempty"`
+	Env        map[string]string `json:"env,omitempty"`
+}
+
+// LaunchApp starts what a rule or the fallback browser launches,
+// see BuildLaunch
+func LaunchApp(l *config.Launch, ctx *template.Context) error {
+	cmd, err := BuildLaunch(l, ctx)
+	if err != nil {
+		return err
+	}
+	return cmd.Start()
+}
+
+// BuildLaunch expands the arguments of l and builds its command
+func BuildLaunch(l *config.Launch, ctx *template.Context) (*Command, error) {
+	argsLine, err := ExpandLaunchArgs(l, ctx)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := BuildCommand(l.Program, argsLine)
+	if err != nil {
+		return nil, err
+	}
+	if cmd.WorkingDir, err = expandValue(l.WorkingDir, ctx); err != nil {
+		return nil, fmt.Errorf("workingDir: %w", err)
+	}
+	if len(l.Env) > 0 {
+		cmd.Env = make(map[string]string, len(l.Env))
+		for name, value := range l.Env {
+			if cmd.Env[name], err = expandValue(value, ctx); err != nil {
+				return nil, fmt.Errorf("env %s: %w", name, err)
+			}
+		}
+	}
+	return cmd, nil
+}
+
+// expandValue expands placeholders in a working directory or environment
+// value. It never lands on a command line, so nothing is quoted.
+func expandValue(src string, ctx *template.Context) (string, error) {
+	if src == "" {
+		return "", nil
+	}
+	ctx.Escape = template.EscapeRaw
+	value, err := template.Expand(src, ctx)
+	if err != nil {
+		logger.Log("Error: " + err.Error())
+	}
+	return value, err
+}
+
+// EnvList returns the environment added for the command, sorted by name
+func (c *Command) EnvList() []string {
+	names := make([]string, 0, len(c.Env))
+	for name := range c.Env {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for i, name := range names {
+		names[i] = name + "=" + c.Env[name]
+	}
+	return names
+}
+
+// BuildCommand resolves the program and builds the final command line,
+// refusing to launch linkrouter itself. Variables in programPath are expanded
+// by the caller, see config.ExpandPath.
+func BuildCommand(programPath, argsLine string) (*Command, error) {
 	if programPath == "" {
 		logger.Log("Error: program path is empty")
-		return fmt.Errorf("program path is empty")
+		return nil, fmt.Errorf("program path is empty")
 	}
-	program, _ := utils.LookupInPATH(expandPath(programPath))
+	program, _ := utils.LookupInPATH(programPath)
 
 	if utils.IsLinkRouter(program) {
 		logger.Log(fmt.Sprintf(
 			"Recursion: program %q specified in rule is linkrouter itself. skipping rule.",
 			program))
-		return fmt.Errorf("recursion prevented.\n" +
+		return nil, fmt.Errorf("recursion prevented.\n" +
 			"program specified in rule is linkrouter itself.\n" +
 			"skipping rule")
 	}
 
 	quotedProgram := strconv.Quote(program)
 
-	var argsLine string
-	if argsTemplate == "" {
-		argsLine = ""
-	} else {
-		argsLine = strings.ReplaceAll(argsTemplate, "{URL}", url)
-		logger.Log(fmt.Sprintf("Expanded arguments: %s", argsLine))
-	}
 	if isExplorer(program) && containsSupportedProtocol(argsLine) {
 		logger.Log("Recursion: URL is passed to explorer.exe and LinkRouter is set as default for this type of links")
-		return fmt.Errorf("recursion prevented.\n" +
+		return nil, fmt.Errorf("recursion prevented.\n" +
 			"link is passed to explorer.exe and LinkRouter is set as default for this type of links")
 	}
 	if isExplorer(program) {
@@ -279,21 +358,95 @@ func LaunchApp(programPath, argsTemplate, url string) error {
 		fullCmdLine = quotedProgram + " " + argsLine
 	}
 
-	logger.Log(fmt.Sprintf("Launching: %s", fullCmdLine))
+	return &Command{
+		Program:     program,
+		Arguments:   argsLine,
+		CommandLine: fullCmdLine,
+	}, nil
+}
 
-	cmd := exec.Command(program)
-	cmd.Path = program
+func (c *Command) Start() error {
+	logger.Log(fmt.Sprintf("Launching: %s", c.CommandLine))
+	if c.WorkingDir != "" {
+		logger.Log(fmt.Sprintf("Working directory: %s", c.WorkingDir))
+	}
+	if len(c.Env) > 0 {
+		logger.Log(fmt.Sprintf("Environment: %s", strings.Join(c.EnvList(), " ")))
+	}
+
+	cmd := exec.Command(c.Program)
+	cmd.Path = c.Program
 	cmd.SysProcAttr = &syscall.SysProcAttr{
-		CmdLine: fullCmdLine,
+		CmdLine: c.CommandLine,
+	}
+	cmd.Dir = c.WorkingDir
+	if len(c.Env) > 0 {
+		// later entries win over the inherited ones
+		cmd.Env = append(os.Environ(), c.EnvList()...)
 	}
 	return cmd.Start()
 }
 
-func ExpandPlaceholders(template string, matches []string) string {
-	result := template
-	for i, match := range matches {
-		placeholder := "$" + strconv.Itoa(i)
-		result = strings.ReplaceAll(result, placeholder, match)
+// TemplateContext collects placeholder values for a matched rule,
+// or for the fallback browser when rule is nil
+func TemplateContext(link *config.Link, rule *config.Rule, matches []string) *template.Context {
+	ctx := &template.Context{
+		URL:        link.Target(rule),
+		URLRaw:     link.Raw,
+		URLDecoded: link.Decoded,
+		Profile:    config.ActiveProfile,
+		Matches:    matches,
+	}
+	if rule != nil {
+		ctx.Names = rule.GroupNames()
+	}
+	return ctx
+}
+
+// ExpandPlaceholders expands capture groups and {URL} placeholders in one pass,
+// so text coming from the link is never expanded again.
+func ExpandPlaceholders(argsTemplate string, ctx *template.Context) (string, error) {
+	if argsTemplate == "" {
+		return "", nil
+	}
+	ctx.Escape = template.EscapeQuoted
+	argsLine, err := template.Expand(argsTemplate, ctx)
+	if err != nil {
+		logger.Log("Error: " + err.Error())
+		return "", err
+	}
+	logger.Log(fmt.Sprintf("Expanded arguments: %s", argsLine))
+	return argsLine, nil
+}
+
+// ExpandArgs expands every element of an argv template and quotes it per
+// MSVCRT rules, so no matter what the link contains it stays one argument.
+func ExpandArgs(args []string, ctx *template.Context) (string, error) {
+	// every element is quoted as a whole below, so placeholders go in raw
+	ctx.Escape = template.EscapeRaw
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		expanded, err := template.Expand(arg, ctx)
+		if err != nil {
+			logger.Log("Error: " + err.Error())
+			return "", err
+		}
+		quoted = append(quoted, syscall.EscapeArg(expanded))
+	}
+	argsLine := strings.Join(quoted, " ")
+	logger.Log(fmt.Sprintf("Expanded arguments: %s", argsLine))
+	return argsLine, nil
+}
+
+// ExpandLaunchArgs expands the arguments string of l, then its Args
+func ExpandLaunchArgs(l *config.Launch, ctx *template.Context) (string, error) {
+	argsLine, err := ExpandPlaceholders(l.Arguments, ctx)
+	if err != nil || len(l.Args) == 0 {
+		return argsLine, err
+	}
+	args, err := ExpandArgs(l.Args, ctx)
+	if err != nil {
+		return "", err
 	}
-	return result
+	return strings.TrimSpace(argsLine + " " + args), nil
 }
@@ -0,0 +1,104 @@
+package launcher
+
+import (
+	"testing"
+
+	"linkrouter/internal/config"
+	"linkrouter/internal/template"
+)
+
+func argsContext() *template.Context {
+	return &template.Context{
+		URL:     `https://example.com/?q="a b"`,
+		Matches: []string{"all", "plain", "x y", `dir\`, `a\"b`},
+	}
+}
+
+func TestExpandArgs(t *testing.T) {
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{nil, ""},
+		{[]string{"--new-window"}, "--new-window"},
+		{[]string{"$1"}, "plain"},
+		{[]string{"$2"}, `"x y"`},
+		{[]string{"$3"}, `dir\`},
+		{[]string{"$4"}, `a\\\"b`},
+		{[]string{"${9}"}, `""`},
+		{[]string{"{URL}"}, `"https://example.com/?q=\"a b\""`},
+		{[]string{"steam://openurl/{URL}"}, `"steam://openurl/https://example.com/?q=\"a b\""`},
+		{[]string{"--dir=$2\\"}, `"--dir=x y\\"`},
+		{[]string{"-m", "$2", "?q=$1"}, `-m "x y" ?q=plain`},
+		// quotes in the template are text too, not quoting
+		{[]string{`"$1"`}, `\"plain\"`},
+		{[]string{"$$1", "$1"}, "$1 plain"},
+	}
+	for _, tt := range tests {
+		got, err := ExpandArgs(tt.args, argsContext())
+		if err != nil {
+			t.Errorf("ExpandArgs(%q): %v", tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ExpandArgs(%q) = %s, want %s", tt.args, got, tt.want)
+		}
+	}
+
+	if _, err := ExpandArgs([]string{"ok", "${1"}, argsContext()); err == nil {
+		t.Error("ExpandArgs with a broken template succeeded, want an error")
+	}
+}
+
+func TestExpandLaunchArgs(t *testing.T) {
+	tests := []struct {
+		arguments string
+		args      []string
+		want      string
+	}{
+		{"", nil, ""},
+		{"$2", nil, `"x y"`},
+		{"", []string{"$2"}, `"x y"`},
+		{"--profile $1", []string{"{URL}"}, `--profile "plain" "https://example.com/?q=\"a b\""`},
+	}
+	for _, tt := range tests {
+		l := &config.Launch{Arguments: tt.arguments, Args: tt.args}
+		got, err := ExpandLaunchArgs(l, argsContext())
+		if err != nil {
+			t.Errorf("ExpandLaunchArgs(%q, %q): %v", tt.arguments, tt.args, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ExpandLaunchArgs(%q, %q) = %s, want %s", tt.arguments, tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestExpandFilePath(t *testing.T) {
+	tests := []struct {
+		file, value string
+		want        string
+		ok          bool
+	}{
+		{"logs/links.txt", "..", "logs/links.txt", true},
+		{"logs/$1.txt", "work", "logs/work.txt", true},
+		{"logs/$1.txt", "a.b", "logs/a.b.txt", true},
+		{"logs/day-$1/links.txt", "7", "logs/day-7/links.txt", true},
+		{"$1.txt", "work", "work.txt", true},
+		{"logs/$1.txt", "..", "", false},
+		{"logs/$1.txt", "../../evil", "", false},
+		{"logs/$1.txt", `..\..\evil`, "", false},
+		{"logs/$1.txt", "a/b", "", false},
+		{"logs/$1.txt", "C:evil", "", false},
+		{"logs/x$1", "...", "", false},
+		{"logs/{URL.path}.txt", "", "", false},
+		{"logs/${1", "x", "", false},
+	}
+	for _, tt := range tests {
+		ctx := &template.Context{URL: "https://example.com/a/b", Matches: []string{"all", tt.value}}
+		got, err := expandFilePath(tt.file, ctx)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("expandFilePath(%q) with $1 = %q: %q, %v, want %q, ok %v", tt.file, tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
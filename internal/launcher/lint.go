@@ -0,0 +1,369 @@
+package launcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"linkrouter/internal/config"
+	"linkrouter/internal/template"
+	"linkrouter/internal/utils"
+	"os"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+)
+
+// Lint severities
+const (
+	LintError   = config.SeverityError
+	LintWarning = config.SeverityWarning
+)
+
+// LintIssue is a problem found in the config. Rule is -1 for global settings.
+type LintIssue struct {
+	Rule     int    `json:"rule"`
+	Severity string `json:"severity"`
+	Kind     string `json:"kind"`
+	Message  string `json:"message"`
+}
+
+// max example strings generated per rule for shadowing checks
+const lintSamples = 16
+
+// Lint analyses rules for problems that don't break loading but make rules
+// misbehave: broken or duplicate patterns, rules that can never fire, etc.
+func Lint(cfg *config.Config) []LintIssue {
+	var issues []LintIssue
+	add := func(rule int, severity, kind, format string, args ...any) {
+		issues = append(issues, LintIssue{
+			Rule:     rule,
+			Severity: severity,
+			Kind:     kind,
+			Message:  fmt.Sprintf(format, args...),
+		})
+	}
+
+	broken := map[int]bool{}
+	for _, p := range cfg.Problems {
+		add(p.Rule, p.Severity, "schema", "%s", p)
+		if p.Severity == LintError {
+			broken[p.Rule] = true
+		}
+	}
+
+	seen := map[string]int{}
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if broken[i] {
+			continue
+		}
+		if err := rule.Validate(); err != nil {
+			add(i, LintError, "invalid", "%s", err)
+			continue
+		}
+
+		key := ruleKey(rule)
+		if first, ok := seen[key]; ok {
+			add(i, LintWarning, "duplicate", "same pattern as rule #%d, this rule never fires", first)
+			continue
+		}
+		seen[key] = i
+
+		if by := shadowedBy(cfg, i); by >= 0 {
+			add(i, LintWarning, "shadowed", "every sample link is caught by rule #%d above", by)
+		}
+
+		if rule.Regex != "" && rule.Host == "" && !isAnchored(rule.Regex) && !startsWithScheme(rule.Regex) {
+			add(i, LintWarning, "unanchored",
+				"regex %q can match anywhere in a link, e.g. inside a query string. Anchor it with ^", rule.Regex)
+		}
+
+		lintGroupRefs(rule, func(format string, args ...any) {
+			add(i, LintWarning, "placeholder", format, args...)
+		})
+
+		// launches that can't be resolved are reported when the config is loaded
+		if l, err := cfg.RuleLaunch(rule); err == nil && l.Program != "" {
+			if msg := unresolvedProgram(l.Program); msg != "" {
+				add(i, LintWarning, "program", "%s", msg)
+			}
+		}
+	}
+
+	// fallbackBrowserPath goes first when set
+	fallbacks := cfg.Fallbacks()
+	offset := len(fallbacks) - len(cfg.Global.Fallbacks)
+	for i := range fallbacks {
+		where := "fallbackBrowserPath"
+		if i >= offset {
+			where = fmt.Sprintf("fallbacks[%d]", i-offset)
+		}
+		if fallbacks[i].SystemDefault {
+			continue
+		}
+		if l, err := cfg.FallbackLaunch(&fallbacks[i]); err == nil && l.Program != "" {
+			if msg := unresolvedProgram(l.Program); msg != "" {
+				add(-1, LintWarning, "program", "%s: %s", where, msg)
+			}
+		}
+	}
+
+	for _, proto := range cfg.Global.SupportedProtocols {
+		proto = strings.ToLower(strings.TrimSpace(proto))
+		proto = strings.TrimSuffix(strings.TrimSuffix(proto, "://"), ":")
+		if proto == "" || proto == "linkrouter-ext" {
+			continue
+		}
+		if !protocolCovered(cfg, proto) {
+			add(-1, LintWarning, "protocol", "no rule or fallback handles %s: links", proto)
+		}
+	}
+	return issues
+}
+
+// ruleKey identifies rules that match exactly the same links
+func ruleKey(rule *config.Rule) string {
+	data, _ := json.Marshal(struct {
+		Regex   string
+		MatchOn string
+		Match   config.URLMatcher
+		Exclude []config.Exclusion
+	}{rule.Regex, strings.ToLower(rule.MatchOn), rule.URLMatcher, rule.Exclude})
+	return string(data)
+}
+
+// shadowedBy samples links the rule is meant for, from its tests or generated
+// from its own pattern, and returns the earlier rule catching all of them, or -1
+func shadowedBy(cfg *config.Config, index int) int {
+	rule := &cfg.Rules[index]
+	by := -1
+	for _, sample := range ruleSamples(rule) {
+		if matches, err := rule.Match(sample); err != nil || len(matches) == 0 {
+			continue
+		}
+		winner := config.Matched(cfg.Explain(config.ParseLink(sample)))
+		if winner == nil || winner.Index >= index {
+			return -1
+		}
+		if by < 0 {
+			by = winner.Index
+		}
+	}
+	return by
+}
+
+func ruleSamples(rule *config.Rule) []string {
+	var samples []string
+	if rule.Tests != nil {
+		for _, test := range rule.Tests.Match {
+			samples = append(samples, test.URL)
+		}
+	}
+	if rule.Regex != "" {
+		if parsed, err := syntax.Parse(rule.Regex, syntax.Perl); err == nil {
+			samples = append(samples, regexExamples(parsed.Simplify())...)
+		}
+	}
+	if !rule.URLMatcher.IsEmpty() {
+		samples = append(samples, matcherExample(&rule.URLMatcher))
+	}
+	return samples
+}
+
+// regexExamples generates strings matching re, one per alternation branch
+// where possible, up to lintSamples
+func regexExamples(re *syntax.Regexp) []string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return []string{string(re.Rune)}
+	case syntax.OpCharClass:
+		if len(re.Rune) == 0 {
+			return nil
+		}
+		for _, r := range "a0" {
+			for k := 0; k+1 < len(re.Rune); k += 2 {
+				if re.Rune[k] <= r && r <= re.Rune[k+1] {
+					return []string{string(r)}
+				}
+			}
+		}
+		return []string{string(re.Rune[0])}
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return []string{"a"}
+	case syntax.OpCapture, syntax.OpPlus:
+		return regexExamples(re.Sub[0])
+	case syntax.OpConcat:
+		examples := []string{""}
+		for _, sub := range re.Sub {
+			subExamples := regexExamples(sub)
+			if len(subExamples) == 0 {
+				return nil
+			}
+			var next []string
+			for _, prefix := range examples {
+				for _, s := range subExamples {
+					if len(next) < lintSamples {
+						next = append(next, prefix+s)
+					}
+				}
+			}
+			examples = next
+		}
+		return examples
+	case syntax.OpAlternate:
+		var examples []string
+		for _, sub := range re.Sub {
+			examples = append(examples, regexExamples(sub)...)
+		}
+		if len(examples) > lintSamples {
+			examples = examples[:lintSamples]
+		}
+		return examples
+	case syntax.OpNoMatch:
+		return nil
+	}
+	// star, quest, anchors and empty matches contribute nothing
+	return []string{""}
+}
+
+func matcherExample(m *config.URLMatcher) string {
+	unglob := strings.NewReplacer("*", "x", "?", "x", "[", "", "]", "")
+	scheme := m.Scheme
+	if scheme == "" {
+		scheme = "https"
+	}
+	host := unglob.Replace(strings.TrimPrefix(m.Host, "."))
+	if host == "" {
+		host = "example.com"
+	}
+	if m.Port != "" {
+		host += ":" + m.Port
+	}
+	path := m.PathPrefix
+	if m.PathGlob != "" {
+		path = unglob.Replace(m.PathGlob)
+	}
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	var query []string
+	for key, value := range m.Query {
+		query = append(query, key+"="+unglob.Replace(value))
+	}
+	example := scheme + "://" + host + path
+	if len(query) > 0 {
+		example += "?" + strings.Join(query, "&")
+	}
+	return example
+}
+
+func lintGroupRefs(rule *config.Rule, warn func(format string, args ...any)) {
+	groups := 0
+	if rule.Regex != "" {
+		re, err := regexp.Compile(rule.Regex)
+		if err != nil {
+			return
+		}
+		groups = re.NumSubexp()
+	}
+	templates := append([]string{rule.Arguments}, rule.Args...)
+	for _, src := range templates {
+		t, err := template.Parse(src)
+		if err != nil {
+			continue
+		}
+		// unknown named groups are load errors, see config.Problem
+		for _, ref := range t.Refs() {
+			if ref.Group > groups {
+				warn("%s is beyond the %d capture group(s) of the regex", ref, groups)
+			}
+		}
+	}
+}
+
+// isAnchored reports whether regex can only match at the start of the link
+func isAnchored(regex string) bool {
+	first := firstNode(regex)
+	return first != nil && (first.Op == syntax.OpBeginText || first.Op == syntax.OpBeginLine)
+}
+
+// schemePrefix is a scheme such as https: at the start of a literal
+var schemePrefix = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9+.-]*:`)
+
+// startsWithScheme tells if regex starts with a literal scheme, like
+// https://(.*). Such a regex only matches inside a link where another link is
+// embedded, which is rare enough not to warn about.
+func startsWithScheme(regex string) bool {
+	first := firstNode(regex)
+	return first != nil && first.Op == syntax.OpLiteral &&
+		schemePrefix.MatchString(string(first.Rune))
+}
+
+// firstNode returns the first node of the parsed regex, looking into
+// concatenations and groups, or nil
+func firstNode(regex string) *syntax.Regexp {
+	parsed, err := syntax.Parse(regex, syntax.Perl)
+	if err != nil {
+		return nil
+	}
+	for parsed.Op == syntax.OpConcat || parsed.Op == syntax.OpCapture {
+		if len(parsed.Sub) == 0 {
+			return nil
+		}
+		parsed = parsed.Sub[0]
+	}
+	return parsed
+}
+
+func unresolvedProgram(programPath string) string {
+	program, err := utils.LookupInPATH(programPath)
+	if err != nil {
+		return fmt.Sprintf("program %q not found in PATH", programPath)
+	}
+	if _, err := os.Stat(program); err != nil {
+		return fmt.Sprintf("program %q does not exist", program)
+	}
+	return ""
+}
+
+// protocolCovered reports whether a link of this protocol goes anywhere useful
+func protocolCovered(cfg *config.Config, proto string) bool {
+	for _, sample := range []string{proto + "://example.com/", proto + ":user@example.com"} {
+		if config.Matched(cfg.Explain(config.ParseLink(sample))) != nil {
+			return true
+		}
+	}
+	// the fallback browser only makes sense for web links
+	return len(cfg.Fallbacks()) > 0 && (proto == "http" || proto == "https")
+}
+
+// RunLint loads the config, prints found issues and returns the process exit code,
+// which is non-zero when there are errors
+func RunLint(asJSON bool, w io.Writer) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Fprintln(w, "config error: "+err.Error())
+		return 1
+	}
+	issues := Lint(cfg)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(issues)
+	} else {
+		for _, issue := range issues {
+			where := "global"
+			if issue.Rule >= 0 && issue.Rule < len(cfg.Rules) {
+				where = fmt.Sprintf("rule #%d%s", issue.Rule, config.FromFile(cfg.Rules[issue.Rule].File))
+			}
+			fmt.Fprintf(w, "%-7s %s [%s]: %s\n", issue.Severity, where, issue.Kind, issue.Message)
+		}
+		fmt.Fprintf(w, "\n%d issue(s) found\n", len(issues))
+	}
+	for _, issue := range issues {
+		if issue.Severity == LintError {
+			return 1
+		}
+	}
+	return 0
+}
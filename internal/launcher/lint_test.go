@@ -0,0 +1,46 @@
+package launcher
+
+import (
+	"testing"
+
+	"linkrouter/internal/config"
+)
+
+func TestLintDefaultConfigIsClean(t *testing.T) {
+	cfg := config.DefaultConfig()
+	if cfg.Global.FallbackBrowserPath == "" {
+		t.Skip("no default browser to build the config around")
+	}
+	for _, issue := range Lint(cfg) {
+		t.Errorf("default config: rule #%d: %s: %s", issue.Rule, issue.Kind, issue.Message)
+	}
+}
+
+func TestUnanchored(t *testing.T) {
+	tests := []struct {
+		regex string
+		warn  bool
+	}{
+		{`^https://zoom\.us/`, false},
+		{`(^https://zoom\.us/)`, false},
+		{`https://(.*)`, false},
+		{`(?i)HTTPS://zoom\.us/`, false},
+		{`mailto:(.*)`, false},
+		{`zoom\.us/j/(\d+)`, true},
+		{`.*zoom\.us`, true},
+		{`(https|http)://zoom\.us`, true},
+		{`://zoom\.us`, true},
+	}
+	for _, tt := range tests {
+		cfg := &config.Config{Rules: []config.Rule{{Regex: tt.regex, Program: "notepad.exe"}}}
+		warned := false
+		for _, issue := range Lint(cfg) {
+			if issue.Kind == "unanchored" {
+				warned = true
+			}
+		}
+		if warned != tt.warn {
+			t.Errorf("Lint of %q warns unanchored = %v, want %v", tt.regex, warned, tt.warn)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package launcher
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"linkrouter/internal/config"
+	"linkrouter/internal/dialogs"
+	"linkrouter/internal/logger"
+	"linkrouter/internal/utils"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Decision describes how a link was (or would be) routed
+type Decision struct {
+	URL        string `json:"url"`
+	RawURL     string `json:"rawUrl"`
+	DecodedURL string `json:"decodedUrl"`
+	// Profile is the active profile, see config.ApplyProfile
+	Profile   string `json:"profile,omitempty"`
+	RuleIndex int    `json:"ruleIndex"`
+	Regex     string `json:"regex,omitempty"`
+	// RuleFile is the included file the rule comes from
+	RuleFile string   `json:"ruleFile,omitempty"`
+	Groups   []string `json:"groups,omitempty"`
+	Command  *Command `json:"command,omitempty"`
+	// Actions are the actions of the rule, when it has them, after those of
+	// rules that failed before it with onFailure nextRule
+	Actions []ActionResult `json:"actions,omitempty"`
+	// Blocked is the reason of the block action that stopped the link
+	Blocked     string `json:"blocked,omitempty"`
+	Interactive bool   `json:"interactive,omitempty"`
+	Fallback    bool   `json:"fallback,omitempty"`
+	// FallbackErrors tell why fallback browsers tried before Command failed
+	FallbackErrors []string `json:"fallbackErrors,omitempty"`
+	Error          string   `json:"error,omitempty"`
+	// Trace lists every rule evaluated, up to the winner
+	Trace []config.RuleTrace `json:"trace,omitempty"`
+	// Problems found in the config when it was loaded
+	Problems []config.Problem `json:"problems,omitempty"`
+}
+
+func (d *Decision) fail(err string) {
+	if d.Error == "" {
+		d.Error = err
+	} else {
+		d.Error += "\n" + err
+	}
+}
+
+// Route runs the whole routing pipeline for url. With dryRun nothing is launched
+// and no dialogs are shown, the returned decision tells what would have been.
+func Route(cfg *config.Config, url string, dryRun bool) *Decision {
+	showError := dialogs.ShowError
+	if dryRun {
+		showError = func(string) {}
+	}
+
+	link := config.ParseLink(url)
+	d := &Decision{
+		URL:        link.Original,
+		RawURL:     link.Raw,
+		DecodedURL: link.Decoded,
+		Profile:    config.ActiveProfile,
+		RuleIndex:  -1,
+	}
+	if d.Profile != "" {
+		logger.Log(fmt.Sprintf("Handling URL: %s (profile %s)", link.Original, d.Profile))
+	} else {
+		logger.Log(fmt.Sprintf("Handling URL: %s", link.Original))
+	}
+	if link.FromExtension {
+		logger.Log(fmt.Sprintf("Unwrapped URL: %s", link.Raw))
+	}
+	if link.Decoded != link.Raw {
+		logger.Log(fmt.Sprintf("Decoded URL: %s", link.Decoded))
+	}
+
+	if hasControlChars(link.Raw) || hasControlChars(link.Decoded) {
+		logger.Log(fmt.Sprintf("Error: rejected URL with control characters: %q", link.Decoded))
+		showError(fmt.Sprintf("link contains control characters and was rejected:\n%q", link.Decoded))
+		d.fail("link contains control characters")
+		return d
+	}
+
+	d.Trace = cfg.Explain(link)
+	config.ReportTrace(d.Trace, !dryRun)
+	for t := config.Matched(d.Trace); t != nil; t = config.Matched(d.Trace) {
+		rule, matches, ruleIndex := &cfg.Rules[t.Index], t.Groups, t.Index
+		logger.Log(fmt.Sprintf("Matched rule #%d: regex=%q%s", ruleIndex, rule.Regex, config.FromFile(rule.File)))
+		logger.Log(fmt.Sprintf("Captured groups: %s", logger.FormatCaptureGroups(matches)))
+		d.RuleIndex = ruleIndex
+		d.Regex = rule.Regex
+		d.RuleFile = rule.File
+		d.Groups = matches
+
+		var err error
+		if len(rule.Actions) > 0 {
+			err = d.runActions(cfg, rule, link, matches, dryRun)
+		} else {
+			err = d.launchRule(cfg, rule, link, matches, dryRun)
+		}
+		if err == nil {
+			return d
+		}
+		d.Command = nil
+		t.Status = config.TraceSkipped
+		t.Error = err.Error()
+		t.OnFailure = rule.FailurePolicy()
+		logger.Log(fmt.Sprintf("Error: rule #%d failed: %s", ruleIndex, err))
+
+		if t.OnFailure == config.OnFailureNextRule {
+			// no dialog, but the exit code tells, and the actions that ran stay listed
+			d.fail(fmt.Sprintf("rule #%d: %s", ruleIndex, err))
+			logger.Log(fmt.Sprintf("onFailure nextRule: matching from rule #%d", ruleIndex+1))
+			d.RuleIndex, d.Regex, d.RuleFile, d.Groups = -1, "", "", nil
+			next := cfg.ExplainFrom(link, ruleIndex+1)
+			config.ReportTrace(next, !dryRun)
+			d.Trace = append(d.Trace, next...)
+			continue
+		}
+
+		d.fail(err.Error())
+		target := rule.Program
+		switch {
+		case len(rule.Actions) > 0:
+			target = fmt.Sprintf("actions of rule #%d", ruleIndex)
+		case rule.App != "":
+			target = config.AppPrefix + rule.App
+		}
+		showError(fmt.Sprintf(
+			"failed to launch app\n%s:\n%s",
+			target,
+			err,
+		))
+		if t.OnFailure == config.OnFailureError {
+			logger.Log("onFailure error: link not opened")
+			return d
+		}
+		logger.Log("onFailure fallback: no rule for the link")
+		break
+	}
+
+	if cfg.Global.InteractiveMode {
+		exe, _ := os.Executable()
+		exeDir := filepath.Dir(exe)
+		guiPath := filepath.Join(exeDir, "linkrouter-gui.exe")
+
+		if _, err := os.Stat(guiPath); err == nil {
+			quotedGUI := strconv.Quote(guiPath)
+			guiArgs := `--interactive --url=` + strconv.Quote(link.Raw)
+			cmd := &Command{
+				Program:     guiPath,
+				Arguments:   guiArgs,
+				CommandLine: quotedGUI + " " + guiArgs,
+			}
+			d.Interactive = true
+			d.Command = cmd
+			if dryRun {
+				return d
+			}
+
+			err := cmd.Start()
+			if err == nil {
+				logger.Log("Interactive GUI launched successfully")
+				os.Exit(0)
+			} else {
+				logger.Log("Failed to launch GUI: " + err.Error())
+				d.Interactive = false
+				d.Command = nil
+			}
+		}
+	}
+
+	d.Fallback = true
+	if len(cfg.Fallbacks()) == 0 {
+		errorText := "Error: no rule matched and no default browser configured"
+		d.fail(errorText)
+		logger.Log(errorText)
+		showError(errorText)
+		return d
+	}
+	cmd, failed, err := openFallback(cfg, link, dryRun)
+	d.Command = cmd
+	d.FallbackErrors = failed
+	if err != nil {
+		d.fail(err.Error())
+		logger.Log(fmt.Sprintf("Error: failed to launch fallback browser. %s", err))
+		showError(fmt.Sprintf(
+			"failed to launch fallback browser:\n%s",
+			strings.Join(failed, "\n")))
+	}
+	return d
+}
+
+// openFallback starts the first fallback browser that starts, in the order of
+// config.FallbackOrder, and returns its command. failed tells why the ones
+// before it didn't. When there are several, the failures are remembered so
+// that those browsers are tried last for a while.
+func openFallback(cfg *config.Config, link *config.Link, dryRun bool) (cmd *Command, failed []string, err error) {
+	chain := cfg.FallbackOrder()
+	var failedKeys []string
+	record := func(started string) {
+		if dryRun || len(chain) < 2 {
+			return
+		}
+		if err := config.RecordFallbacks(failedKeys, started); err != nil {
+			logger.Log("Error: can't remember failed fallback browsers: " + err.Error())
+		}
+	}
+	for i := range chain {
+		f := &chain[i]
+		var l *config.Launch
+		l, err = cfg.FallbackLaunch(f)
+		if err == nil {
+			cmd, err = BuildLaunch(l, TemplateContext(link, nil, nil))
+		}
+		if err == nil && utils.IsLinkRouter(cmd.Program) {
+			err = errors.New("it is LinkRouter itself")
+		}
+		if err == nil {
+			err = start(cmd, dryRun)
+		}
+		if err == nil {
+			if i > 0 {
+				logger.Log("Fallback browser " + f.Key() + " started")
+			}
+			record(f.Key())
+			return cmd, failed, nil
+		}
+		failed = append(failed, fmt.Sprintf("%s: %s", f.Key(), err))
+		failedKeys = append(failedKeys, f.Key())
+		logger.Log(fmt.Sprintf("Fallback browser %s failed: %s", f.Key(), err))
+	}
+	record("")
+	if len(chain) > 1 {
+		err = errors.New("no fallback browser started")
+	}
+	return nil, failed, err
+}
+
+// launchRule starts the program or app of rule. On a dry run it only builds
+// the command.
+func (d *Decision) launchRule(cfg *config.Config, rule *config.Rule, link *config.Link, matches []string, dryRun bool) error {
+	l, err := cfg.RuleLaunch(rule)
+	if err != nil {
+		return err
+	}
+	if l.App != "" {
+		logger.Log("App: " + l.App)
+	}
+	cmd, err := BuildLaunch(l, TemplateContext(link, rule, matches))
+	if err != nil {
+		return err
+	}
+	d.Command = cmd
+	return start(cmd, dryRun)
+}
+
+// start starts cmd. A dry run only checks that the program exists, so that
+// the decision takes the path a real run would.
+func start(cmd *Command, dryRun bool) error {
+	if !dryRun {
+		return cmd.Start()
+	}
+	if msg := unresolvedProgram(cmd.Program); msg != "" {
+		return errors.New(msg)
+	}
+	return nil
+}
+
+// ExitCode is the exit status of linkrouter.exe for the decision: 0 when the
+// link was handled, 1 when something failed on the way, even if the fallback
+// browser opened it after all, 2 when a block action stopped it. Failed
+// actions with continueOnError don't count.
+func (d *Decision) ExitCode() int {
+	switch {
+	case d.Blocked != "":
+		return 2
+	case d.Error != "":
+		return 1
+	}
+	return 0
+}
+
+// Resolve loads the config and routes url without launching anything.
+// The decision is printed as text or JSON, with explain the per-rule trace too.
+// Returns the process exit code.
+func Resolve(url string, explain, asJSON bool, w io.Writer) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Fprintln(w, "config error: "+err.Error())
+		return 1
+	}
+	cfg.ApplyActiveProfile()
+	d := Route(cfg, url, true)
+	d.Problems = cfg.Problems
+	if !explain {
+		d.Trace = nil
+	}
+
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(d)
+	} else {
+		d.WriteProblems(w)
+		d.WriteTrace(w)
+		d.WriteText(w)
+	}
+	if d.Error != "" && d.Command == nil {
+		return 1
+	}
+	return 0
+}
+
+// WriteProblems prints problems found when the config was loaded
+func (d *Decision) WriteProblems(w io.Writer) {
+	for _, p := range d.Problems {
+		fmt.Fprintf(w, "%-7s %s\n", p.Severity, p)
+	}
+	if len(d.Problems) > 0 {
+		fmt.Fprintln(w)
+	}
+}
+
+// WriteTrace prints the outcome of every evaluated rule
+func (d *Decision) WriteTrace(w io.Writer) {
+	for _, t := range d.Trace {
+		fmt.Fprintf(w, "#%-3d %-9s regex=%q%s\n", t.Index, t.Status, t.Regex, config.FromFile(t.File))
+		if t.Exclusion != "" {
+			fmt.Fprintf(w, "      rejected by %s\n", t.Exclusion)
+		}
+		if t.Error != "" {
+			fmt.Fprintf(w, "      %s\n", strings.ReplaceAll(t.Error, "\n", " "))
+		}
+		if t.OnFailure != "" {
+			fmt.Fprintf(w, "      onFailure: %s\n", t.OnFailure)
+		}
+	}
+	if len(d.Trace) > 0 {
+		fmt.Fprintln(w)
+	}
+}
+
+// WriteText prints the decision in a human readable form
+func (d *Decision) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "URL:          %s\n", d.URL)
+	if d.RawURL != d.URL {
+		fmt.Fprintf(w, "Raw URL:      %s\n", d.RawURL)
+	}
+	if d.DecodedURL != d.RawURL {
+		fmt.Fprintf(w, "Decoded URL:  %s\n", d.DecodedURL)
+	}
+	if d.Profile != "" {
+		fmt.Fprintf(w, "Profile:      %s\n", d.Profile)
+	}
+	if d.RuleIndex >= 0 {
+		fmt.Fprintf(w, "Matched rule: #%d regex=%q%s\n", d.RuleIndex, d.Regex, config.FromFile(d.RuleFile))
+		for i, g := range d.Groups {
+			fmt.Fprintf(w, "  $%d = %q\n", i, g)
+		}
+	} else {
+		fmt.Fprintln(w, "Matched rule: none")
+	}
+	switch {
+	case d.Blocked != "":
+		fmt.Fprintf(w, "Decision:     blocked, %s\n", d.Blocked)
+	case d.Interactive:
+		fmt.Fprintln(w, "Decision:     interactive GUI")
+	case d.Fallback:
+		fmt.Fprintln(w, "Decision:     fallback browser")
+	case d.RuleIndex >= 0:
+		fmt.Fprintln(w, "Decision:     rule")
+	}
+	for _, e := range d.FallbackErrors {
+		fmt.Fprintf(w, "Skipped:      %s\n", strings.ReplaceAll(e, "\n", " "))
+	}
+	for _, a := range d.Actions {
+		if a.Rule != d.RuleIndex {
+			fmt.Fprintf(w, "Action #%d of rule #%d, %s, %s", a.Index, a.Rule, a.Type, a.Status)
+		} else {
+			fmt.Fprintf(w, "Action #%-2d   %s, %s", a.Index, a.Type, a.Status)
+		}
+		if a.Ignored {
+			fmt.Fprint(w, ", error ignored")
+		}
+		fmt.Fprintln(w)
+		if a.Detail != "" {
+			fmt.Fprintf(w, "  %s\n", a.Detail)
+		}
+		if a.Command != nil {
+			writeCommand(w, a.Command, "  ")
+		}
+		if a.Error != "" {
+			fmt.Fprintf(w, "  Error: %s\n", strings.ReplaceAll(a.Error, "\n", " "))
+		}
+	}
+	if d.Command != nil {
+		writeCommand(w, d.Command, "")
+	}
+	if d.Error != "" {
+		fmt.Fprintf(w, "Error:        %s\n", strings.ReplaceAll(d.Error, "\n", " "))
+	}
+}
+
+// writeCommand prints a command with its working directory and environment
+func writeCommand(w io.Writer, c *Command, indent string) {
+	fmt.Fprintf(w, "%sProgram:      %s\n", indent, c.Program)
+	fmt.Fprintf(w, "%sArguments:    %s\n", indent, c.Arguments)
+	fmt.Fprintf(w, "%sCommand line: %s\n", indent, c.CommandLine)
+	if c.WorkingDir != "" {
+		fmt.Fprintf(w, "%sWorking dir:  %s\n", indent, c.WorkingDir)
+	}
+	for _, env := range c.EnvList() {
+		fmt.Fprintf(w, "%sEnvironment:  %s\n", indent, env)
+	}
+}
@@ -0,0 +1,139 @@
+package launcher
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"linkrouter/internal/config"
+)
+
+// TestResult is the outcome of one inline rule test
+type TestResult struct {
+	Rule int    `json:"rule"`
+	URL  string `json:"url"`
+	// Expect is config.TraceMatched or config.TraceNoMatch
+	Expect string `json:"expect"`
+	// Winner is the index of the rule the link actually routed to, or -1
+	Winner int    `json:"winner"`
+	Args   string `json:"args,omitempty"`
+	Pass   bool   `json:"pass"`
+	Reason string `json:"reason,omitempty"`
+}
+
+type TestReport struct {
+	Results []TestResult `json:"results"`
+	Passed  int          `json:"passed"`
+	Failed  int          `json:"failed"`
+}
+
+// SelfTest checks every rule's inline tests against the full first-match ordering,
+// so a rule added above can't silently steal links from one below.
+func SelfTest(cfg *config.Config) *TestReport {
+	report := &TestReport{}
+	add := func(r TestResult) {
+		if r.Pass {
+			report.Passed++
+		} else {
+			report.Failed++
+		}
+		report.Results = append(report.Results, r)
+	}
+
+	for i := range cfg.Rules {
+		rule := &cfg.Rules[i]
+		if rule.Tests == nil {
+			continue
+		}
+		for _, test := range rule.Tests.Match {
+			link := config.ParseLink(test.URL)
+			r := TestResult{Rule: i, URL: test.URL, Expect: config.TraceMatched, Winner: -1}
+			trace := cfg.Explain(link)
+			winner := config.Matched(trace)
+			switch {
+			case winner == nil:
+				r.Reason = "no rule matched"
+			case winner.Index != i:
+				r.Winner = winner.Index
+				r.Reason = fmt.Sprintf("routed to rule #%d", winner.Index)
+			default:
+				r.Winner = i
+				var args string
+				l, err := cfg.RuleLaunch(rule)
+				if err == nil {
+					args, err = ExpandLaunchArgs(l, TemplateContext(link, rule, winner.Groups))
+				}
+				r.Args = args
+				switch {
+				case err != nil:
+					r.Reason = err.Error()
+				case test.Args != "" && args != test.Args:
+					r.Reason = fmt.Sprintf("arguments %q, expected %q", args, test.Args)
+				default:
+					r.Pass = true
+				}
+			}
+			for _, t := range trace {
+				if t.Index == i && (t.Status == config.TraceExcluded || t.Status == config.TraceInvalid || t.Status == config.TraceDisabled) {
+					r.Reason = t.Exclusion + t.Error
+					if t.Exclusion != "" {
+						r.Reason = "rejected by " + t.Exclusion
+					}
+				}
+			}
+			add(r)
+		}
+		for _, url := range rule.Tests.NoMatch {
+			r := TestResult{Rule: i, URL: url, Expect: config.TraceNoMatch, Winner: -1}
+			if winner := config.Matched(cfg.Explain(config.ParseLink(url))); winner != nil {
+				r.Winner = winner.Index
+			}
+			r.Pass = r.Winner != i
+			if !r.Pass {
+				r.Reason = "routed to this rule"
+			}
+			add(r)
+		}
+	}
+	return report
+}
+
+// WriteText prints a pass/fail line per test and a summary
+func (report *TestReport) WriteText(w io.Writer) {
+	for _, r := range report.Results {
+		status := "PASS"
+		if !r.Pass {
+			status = "FAIL"
+		}
+		expect := "must match"
+		if r.Expect == config.TraceNoMatch {
+			expect = "must not match"
+		}
+		fmt.Fprintf(w, "%s rule #%d %s %s", status, r.Rule, expect, r.URL)
+		if r.Reason != "" {
+			fmt.Fprintf(w, ": %s", r.Reason)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintf(w, "\n%d passed, %d failed\n", report.Passed, report.Failed)
+}
+
+// RunSelfTest loads the config, prints the report and returns the process exit code
+func RunSelfTest(asJSON bool, w io.Writer) int {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		fmt.Fprintln(w, "config error: "+err.Error())
+		return 1
+	}
+	report := SelfTest(cfg)
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(report)
+	} else {
+		report.WriteText(w)
+	}
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
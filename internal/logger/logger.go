@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
 	"strings"
 	"time"
 )
@@ -12,17 +11,14 @@ import (
 var logFile *os.File
 var enabled bool
 
+// Init opens the log at logPath, relative to the executable. Variables are
+// expanded by the caller, see config.ExpandPath.
 func Init(logPath string) error {
 	if strings.TrimSpace(logPath) == "" {
 		enabled = false
 		return nil
 	}
 
-	// in GO %VARS% are not expanded. so convert then to unix-style
-	re := regexp.MustCompile(`%([_a-zA-Z][_a-zA-Z0-9\-]*)%`)
-	converted := re.ReplaceAllString(logPath, `$${$1}`)
-	logPath = os.ExpandEnv(converted)
-
 	if !filepath.IsAbs(logPath) {
 		exe, _ := os.Executable()
 		exeDir := filepath.Dir(exe)
@@ -0,0 +1,166 @@
+package template
+
+import (
+	urlpkg "net/url"
+	"strings"
+)
+
+// Escape is how a placeholder value is escaped before it lands on the command line
+type Escape string
+
+const (
+	// EscapeQuoted keeps the value within its argument. It adds quotes when the
+	// placeholder is a whole argument, like {URL}. Inside quotes, like "{URL}",
+	// or within an argument, like steam://openurl/{URL}, it only escapes the value.
+	EscapeQuoted Escape = "quoted"
+	// EscapeCmdArg quotes the value only when it contains spaces or quotes
+	EscapeCmdArg Escape = "cmdarg"
+	// EscapeURLEncoded query-escapes the value
+	EscapeURLEncoded Escape = "urlencoded"
+	// EscapeRaw inserts the value as is. Only use it with trusted values
+	EscapeRaw Escape = "raw"
+)
+
+var escapes = map[Escape]bool{
+	EscapeQuoted:     true,
+	EscapeCmdArg:     true,
+	EscapeURLEncoded: true,
+	EscapeRaw:        true,
+}
+
+// mode returns the escape mode of placeholder n, def unless it sets one
+func (n *node) mode(def Escape) Escape {
+	if n.escape != "" {
+		return n.escape
+	}
+	return def
+}
+
+func (n *node) escapeValue(value string, def Escape) string {
+	switch n.mode(def) {
+	case EscapeRaw:
+		return value
+	case EscapeURLEncoded:
+		return urlpkg.QueryEscape(value)
+	case EscapeCmdArg:
+		if value != "" && !strings.ContainsAny(value, " \t\"") {
+			return value
+		}
+		return `"` + quoteArg(value, true) + `"`
+	default:
+		return n.escapeQuoted(value, n.beforeQuote)
+	}
+}
+
+// escapeQuoted escapes value in EscapeQuoted mode. closing tells whether a
+// quote follows, so trailing backslashes must be doubled.
+func (n *node) escapeQuoted(value string, closing bool) string {
+	switch {
+	case n.inQuotes:
+		return quoteArg(value, closing)
+	case n.wholeArg:
+		return `"` + quoteArg(value, true) + `"`
+	}
+	return escapeBare(value, closing)
+}
+
+// quoteArg escapes s to be placed between double quotes, following MSVCRT rules:
+// backslashes are only special in front of a quote.
+// closing tells whether a quote follows s, so trailing backslashes must be doubled.
+func quoteArg(s string, closing bool) string {
+	var out strings.Builder
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			slashes++
+		case '"':
+			out.WriteString(strings.Repeat(`\`, slashes+1))
+			slashes = 0
+		default:
+			slashes = 0
+		}
+		out.WriteByte(c)
+	}
+	if closing {
+		out.WriteString(strings.Repeat(`\`, slashes))
+	}
+	return out.String()
+}
+
+// escapeBare escapes s to be part of an unquoted argument, following MSVCRT
+// rules: quotes are escaped and blanks quoted on their own, so that s neither
+// ends the argument nor starts a quoted region.
+// closing tells whether a quote follows s, so trailing backslashes must be doubled.
+func escapeBare(s string, closing bool) string {
+	var out strings.Builder
+	slashes := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch c {
+		case '\\':
+			slashes++
+			out.WriteByte(c)
+			continue
+		case '"':
+			out.WriteString(strings.Repeat(`\`, slashes+1))
+			out.WriteByte(c)
+		case ' ', '\t':
+			out.WriteString(strings.Repeat(`\`, slashes))
+			out.WriteString(`"` + string(c) + `"`)
+		default:
+			out.WriteByte(c)
+		}
+		slashes = 0
+	}
+	if closing {
+		out.WriteString(strings.Repeat(`\`, slashes))
+	}
+	return out.String()
+}
+
+// markQuotes records for every placeholder whether it sits inside a quoted
+// region of the template text, whether a quote follows it and whether it is
+// a whole argument, with blanks or the ends of the template around it.
+// Placeholders next to each other count as one, see Expand.
+func (t *Template) markQuotes() {
+	inQuotes := false
+	blank := func(c byte) bool { return c == ' ' || c == '\t' }
+	for i := 0; i < len(t.nodes); i++ {
+		n := &t.nodes[i]
+		if n.isRef {
+			end := i
+			for end+1 < len(t.nodes) && t.nodes[end+1].isRef {
+				end++
+			}
+			before := i == 0 || blank(t.nodes[i-1].text[len(t.nodes[i-1].text)-1])
+			after, beforeQuote := true, false
+			if end+1 < len(t.nodes) {
+				next := t.nodes[end+1].text
+				beforeQuote = strings.HasPrefix(next, `"`)
+				after = blank(next[0])
+			}
+			for ; i <= end; i++ {
+				t.nodes[i].inQuotes = inQuotes
+				t.nodes[i].beforeQuote = beforeQuote
+				t.nodes[i].wholeArg = before && after
+			}
+			i = end
+			continue
+		}
+		slashes := 0
+		for j := 0; j < len(n.text); j++ {
+			switch n.text[j] {
+			case '\\':
+				slashes++
+				continue
+			case '"':
+				if slashes%2 == 0 {
+					inQuotes = !inQuotes
+				}
+			}
+			slashes = 0
+		}
+	}
+}
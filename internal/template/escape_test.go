@@ -0,0 +1,177 @@
+package template
+
+import "testing"
+
+func escapeContext(escape Escape) *Context {
+	return &Context{
+		URL:     `https://example.com/?q="a b"`,
+		Matches: []string{"all", "plain", `a "b" c`, `dir\`, `a\"b`, "x y", `" --evil`},
+		Escape:  escape,
+	}
+}
+
+func TestEscapeModes(t *testing.T) {
+	tests := []struct {
+		src    string
+		escape Escape
+		want   string
+	}{
+		// quoted, the default: a whole argument gets quotes
+		{"$1", "", `"plain"`},
+		{"$2", "", `"a \"b\" c"`},
+		{"$3", "", `"dir\\"`},
+		{"$4", "", `"a\\\"b"`},
+		{"/m $1 /x", "", `/m "plain" /x`},
+		{"{URL}", "", `"https://example.com/?q=\"a b\""`},
+		{"$1\t$5", "", "\"plain\"\t\"x y\""},
+		{"${9}", "", `""`},
+
+		// quoted, already inside quotes in the template: only escaped
+		{`"$1"`, "", `"plain"`},
+		{`"$2"`, "", `"a \"b\" c"`},
+		{`"$3"`, "", `"dir\\"`},
+		{`"$3 more"`, "", `"dir\ more"`},
+		{`"--x=$5"`, "", `"--x=x y"`},
+		{`"{URL}"`, "", `"https://example.com/?q=\"a b\""`},
+
+		// quoted, within an argument: escaped, blanks quoted on their own
+		{"steam://openurl/{URL}", "", `steam://openurl/https://example.com/?q=\"a" "b\"`},
+		{"?q=$1", "", "?q=plain"},
+		{"?q=$5&x=1", "", `?q=x" "y&x=1`},
+		{"--dir=$3", "", `--dir=dir\`},
+		{"$1/", "", "plain/"},
+		{"$4x", "", `a\\\"bx`},
+
+		// placeholders next to each other are escaped as one value, so a
+		// backslash ending one doesn't unescape a quote of the next
+		{"$1$5", "", `"plainx y"`},
+		{`"$3$6"`, "", `"dir\\\" --evil"`},
+		{"$3$6", "", `"dir\\\" --evil"`},
+		{"x=$3$6", "", `x=dir\\\"" "--evil`},
+		{`"$3$9"`, "", `"dir\$9"`},
+
+		// cmdarg: quotes only when needed
+		{"$1", EscapeCmdArg, "plain"},
+		{"$5", EscapeCmdArg, `"x y"`},
+		{"$2", EscapeCmdArg, `"a \"b\" c"`},
+		{"${9}", EscapeCmdArg, `""`},
+		{"?q=${5|cmdarg}", "", `?q="x y"`},
+
+		// urlencoded
+		{"$5", EscapeURLEncoded, "x+y"},
+		{"?u={URL}", EscapeURLEncoded, "?u=https%3A%2F%2Fexample.com%2F%3Fq%3D%22a+b%22"},
+		{"?q=${2|urlencoded}", "", "?q=a+%22b%22+c"},
+
+		// raw
+		{"$2", EscapeRaw, `a "b" c`},
+		{"{URL|raw}", "", `https://example.com/?q="a b"`},
+
+		// an explicit mode wins over the default of the context
+		{"${5|quoted}", EscapeRaw, `"x y"`},
+		{"${5|raw}", EscapeCmdArg, "x y"},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.src, escapeContext(tt.escape))
+		if err != nil {
+			t.Errorf("Expand(%q, %s): %v", tt.src, tt.escape, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q, %s) = %s, want %s", tt.src, tt.escape, got, tt.want)
+		}
+	}
+}
+
+func TestQuoteArg(t *testing.T) {
+	tests := []struct {
+		s       string
+		closing bool
+		want    string
+	}{
+		{"", true, ""},
+		{"plain", true, "plain"},
+		{`a"b`, true, `a\"b`},
+		{`a\"b`, true, `a\\\"b`},
+		{`a\b`, true, `a\b`},
+		{`dir\`, true, `dir\\`},
+		{`dir\`, false, `dir\`},
+		{`dir\\`, true, `dir\\\\`},
+	}
+	for _, tt := range tests {
+		if got := quoteArg(tt.s, tt.closing); got != tt.want {
+			t.Errorf("quoteArg(%q, %v) = %s, want %s", tt.s, tt.closing, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeBare(t *testing.T) {
+	tests := []struct {
+		s       string
+		closing bool
+		want    string
+	}{
+		{"", false, ""},
+		{"plain", false, "plain"},
+		{"a b", false, `a" "b`},
+		{"a\tb", false, "a\"\t\"b"},
+		{`a"b`, false, `a\"b`},
+		{`a\"b`, false, `a\\\"b`},
+		{`a\ b`, false, `a\\" "b`},
+		{`a\b`, false, `a\b`},
+		{`dir\`, false, `dir\`},
+		{`dir\`, true, `dir\\`},
+	}
+	for _, tt := range tests {
+		if got := escapeBare(tt.s, tt.closing); got != tt.want {
+			t.Errorf("escapeBare(%q, %v) = %s, want %s", tt.s, tt.closing, got, tt.want)
+		}
+	}
+}
+
+func TestMarkQuotes(t *testing.T) {
+	type flags struct{ inQuotes, beforeQuote, wholeArg bool }
+	tests := []struct {
+		src  string
+		want []flags
+	}{
+		{"$1", []flags{{false, false, true}}},
+		{"a $1 b", []flags{{false, false, true}}},
+		{"a\t$1", []flags{{false, false, true}}},
+		{`"$1"`, []flags{{true, true, false}}},
+		{`"a $1 b"`, []flags{{true, false, true}}},
+		{`"$1" $2`, []flags{{true, true, false}, {false, false, true}}},
+		{"x=$1", []flags{{false, false, false}}},
+		{"$1/", []flags{{false, false, false}}},
+		{"$1$2", []flags{{false, false, true}, {false, false, true}}},
+		{"x=$1$2 y", []flags{{false, false, false}, {false, false, false}}},
+		{`"$1$2"`, []flags{{true, true, false}, {true, true, false}}},
+		{`$1"`, []flags{{false, true, false}}},
+		{`\"$1`, []flags{{false, false, false}}},
+		{`\\"$1"`, []flags{{true, true, false}}},
+		{`"a\"$1"`, []flags{{true, true, false}}},
+		{`"a" $1 "b"`, []flags{{false, false, true}}},
+		{`--x="{URL}" {URL}`, []flags{{true, true, false}, {false, false, true}}},
+	}
+	for _, tt := range tests {
+		tmpl, err := Parse(tt.src)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", tt.src, err)
+			continue
+		}
+		var got []flags
+		for _, n := range tmpl.nodes {
+			if n.isRef {
+				got = append(got, flags{n.inQuotes, n.beforeQuote, n.wholeArg})
+			}
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("Parse(%q): %d placeholders, want %d", tt.src, len(got), len(tt.want))
+			continue
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Errorf("Parse(%q) placeholder %d = %+v, want %+v", tt.src, i, got[i], tt.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,500 @@
+// Package template implements placeholder expansion for rule arguments.
+//
+// Syntax:
+//
+//	$1, ${1}         capture group by number
+//	${id}            named capture group (?P<id>...)
+//	${user:-me}      default value when the group is empty or missing
+//	$$               literal $
+//	{URL}            the link in the form the rule matched, raw or decoded
+//	{URL_RAW}        the link as received, only unwrapped from the extension
+//	{URL_DECODED}    the link with percent-escapes decoded
+//	{URL.host}       URL components: scheme, user, host, port, path, query, fragment
+//	{URL.query.v}    first value of query parameter v
+//	${1|lower|replace "-" "_"}, {URL.host|trimPrefix "www."}
+//	                 pipeline of functions applied left to right
+//	{URL|raw}        escaping mode, last in the pipeline: quoted (default), cmdarg, urlencoded, raw
+//	{PROFILE}        the active profile, empty for none
+package template
+
+import (
+	"encoding/base64"
+	"fmt"
+	urlpkg "net/url"
+	"strconv"
+	"strings"
+)
+
+// Context is the data placeholders are expanded from
+type Context struct {
+	URL        string
+	URLRaw     string
+	URLDecoded string
+	Profile    string
+	Matches    []string
+	// Names are regex subexpression names, as returned by regexp.SubexpNames
+	Names []string
+	// Escape applies to placeholders without an explicit escaping mode.
+	// Empty means EscapeQuoted
+	Escape Escape
+
+	parsed *urlpkg.URL
+	done   bool
+}
+
+func (ctx *Context) parsedURL() *urlpkg.URL {
+	if !ctx.done {
+		ctx.parsed, _ = urlpkg.Parse(ctx.URL)
+		ctx.done = true
+	}
+	return ctx.parsed
+}
+
+// Template is a parsed argument template
+type Template struct {
+	src   string
+	nodes []node
+}
+
+type node struct {
+	text string
+	// for placeholders
+	isRef  bool
+	ref    Ref
+	legacy bool
+	def    string
+	hasDef bool
+	funcs  []call
+	escape Escape
+	// position relative to quotes in the template text
+	inQuotes    bool
+	beforeQuote bool
+	wholeArg    bool
+}
+
+// Ref is a value referenced by a placeholder
+type Ref struct {
+	// Group is a capture group number, or -1
+	Group int
+	// Name is a named group or URL accessor such as "URL.host"
+	Name string
+}
+
+func (r Ref) String() string {
+	if r.Group >= 0 {
+		return "$" + strconv.Itoa(r.Group)
+	}
+	return r.Name
+}
+
+type call struct {
+	name string
+	args []string
+}
+
+type function struct {
+	nargs int
+	fn    func(s string, args []string) string
+}
+
+var functions = map[string]function{
+	"urlencode": {0, func(s string, _ []string) string { return urlpkg.QueryEscape(s) }},
+	"urldecode": {0, func(s string, _ []string) string {
+		if decoded, err := urlpkg.QueryUnescape(s); err == nil {
+			return decoded
+		}
+		return s
+	}},
+	"lower":      {0, func(s string, _ []string) string { return strings.ToLower(s) }},
+	"upper":      {0, func(s string, _ []string) string { return strings.ToUpper(s) }},
+	"base64":     {0, func(s string, _ []string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }},
+	"trimPrefix": {1, func(s string, args []string) string { return strings.TrimPrefix(s, args[0]) }},
+	"trimSuffix": {1, func(s string, args []string) string { return strings.TrimSuffix(s, args[0]) }},
+	"replace":    {2, func(s string, args []string) string { return strings.ReplaceAll(s, args[0], args[1]) }},
+}
+
+var urlAccessors = map[string]func(u *urlpkg.URL) string{
+	"scheme":   func(u *urlpkg.URL) string { return u.Scheme },
+	"user":     func(u *urlpkg.URL) string { return u.User.Username() },
+	"host":     func(u *urlpkg.URL) string { return u.Hostname() },
+	"port":     func(u *urlpkg.URL) string { return u.Port() },
+	"path":     func(u *urlpkg.URL) string { return u.Path },
+	"query":    func(u *urlpkg.URL) string { return u.RawQuery },
+	"fragment": func(u *urlpkg.URL) string { return u.Fragment },
+}
+
+// Parse parses a template. Text that doesn't look like a placeholder is kept as is.
+func Parse(src string) (*Template, error) {
+	t := &Template{src: src}
+	var text strings.Builder
+	flush := func() {
+		if text.Len() > 0 {
+			t.nodes = append(t.nodes, node{text: text.String()})
+			text.Reset()
+		}
+	}
+
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == '$' && i+1 < len(src) && src[i+1] == '$':
+			text.WriteByte('$')
+			i += 2
+		case c == '$' && i+1 < len(src) && isDigit(src[i+1]):
+			j := i + 1
+			for j < len(src) && isDigit(src[j]) {
+				j++
+			}
+			n, _ := strconv.Atoi(src[i+1 : j])
+			flush()
+			t.nodes = append(t.nodes, node{isRef: true, legacy: true, ref: Ref{Group: n}})
+			i = j
+		case c == '$' && i+1 < len(src) && src[i+1] == '{':
+			end := findClose(src, i+2)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated placeholder at offset %d in %q", i, src)
+			}
+			n, err := parsePlaceholder(src[i+2:end], true)
+			if err != nil {
+				return nil, fmt.Errorf("placeholder %q: %w", src[i:end+1], err)
+			}
+			flush()
+			t.nodes = append(t.nodes, n)
+			i = end + 1
+		case c == '{' && isURLName(src[i+1:]):
+			end := findClose(src, i+1)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated placeholder at offset %d in %q", i, src)
+			}
+			n, err := parsePlaceholder(src[i+1:end], false)
+			if err != nil {
+				return nil, fmt.Errorf("placeholder %q: %w", src[i:end+1], err)
+			}
+			flush()
+			t.nodes = append(t.nodes, n)
+			i = end + 1
+		default:
+			text.WriteByte(c)
+			i++
+		}
+	}
+	flush()
+	t.markQuotes()
+	return t, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isIdentByte(c byte) bool {
+	return c == '_' || c == '.' || c == '-' || isDigit(c) ||
+		(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// isURLName reports whether s starts with a URL placeholder name, or PROFILE,
+// followed by } or |
+func isURLName(s string) bool {
+	j := 0
+	for j < len(s) && isIdentByte(s[j]) {
+		j++
+	}
+	name := s[:j]
+	if name != "URL" && name != "PROFILE" && !strings.HasPrefix(name, "URL.") && !strings.HasPrefix(name, "URL_") {
+		return false
+	}
+	return j < len(s) && (s[j] == '}' || s[j] == '|')
+}
+
+// findClose finds the closing brace, skipping quoted function arguments
+func findClose(src string, from int) int {
+	var quote byte
+	for i := from; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '}':
+			return i
+		}
+	}
+	return -1
+}
+
+func parsePlaceholder(body string, allowDefault bool) (node, error) {
+	n := node{isRef: true}
+	parts := splitPipeline(body)
+	head := parts[0]
+	if allowDefault {
+		if k := strings.Index(head, ":-"); k >= 0 {
+			n.def = head[k+2:]
+			n.hasDef = true
+			head = head[:k]
+		}
+	}
+	head = strings.TrimSpace(head)
+	if head == "" {
+		return n, fmt.Errorf("empty name")
+	}
+	for k := 0; k < len(head); k++ {
+		if !isIdentByte(head[k]) {
+			return n, fmt.Errorf("invalid name %q", head)
+		}
+	}
+	if g, err := strconv.Atoi(head); err == nil {
+		n.ref = Ref{Group: g}
+	} else {
+		n.ref = Ref{Group: -1, Name: head}
+		if err := checkURLName(head); err != nil {
+			return n, err
+		}
+	}
+
+	for k, part := range parts[1:] {
+		fields, err := splitArgs(part)
+		if err != nil {
+			return n, err
+		}
+		if len(fields) == 0 {
+			return n, fmt.Errorf("empty function in pipeline")
+		}
+		if escapes[Escape(fields[0])] {
+			if k != len(parts)-2 || len(fields) > 1 {
+				return n, fmt.Errorf("escaping mode %q must be the last element of the pipeline", fields[0])
+			}
+			n.escape = Escape(fields[0])
+			continue
+		}
+		f, ok := functions[fields[0]]
+		if !ok {
+			return n, fmt.Errorf("unknown function %q", fields[0])
+		}
+		if len(fields)-1 != f.nargs {
+			return n, fmt.Errorf("function %q takes %d argument(s), got %d", fields[0], f.nargs, len(fields)-1)
+		}
+		n.funcs = append(n.funcs, call{name: fields[0], args: fields[1:]})
+	}
+	return n, nil
+}
+
+func checkURLName(name string) error {
+	switch name {
+	case "URL", "URL_RAW", "URL_DECODED":
+		return nil
+	}
+	if strings.HasPrefix(name, "URL_") {
+		return fmt.Errorf("unknown placeholder %q", name)
+	}
+	if !strings.HasPrefix(name, "URL.") {
+		return nil
+	}
+	component := strings.TrimPrefix(name, "URL.")
+	if strings.HasPrefix(component, "query.") && len(component) > len("query.") {
+		return nil
+	}
+	if _, ok := urlAccessors[component]; !ok {
+		return fmt.Errorf("unknown URL component %q", component)
+	}
+	return nil
+}
+
+// splitPipeline splits on | outside of quotes
+func splitPipeline(body string) []string {
+	var parts []string
+	var quote byte
+	start := 0
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '|':
+			parts = append(parts, body[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, body[start:])
+}
+
+// splitArgs splits a function call into name and arguments. Arguments may be quoted.
+func splitArgs(s string) ([]string, error) {
+	var fields []string
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t':
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated quote in %q", s)
+			}
+			fields = append(fields, s[i+1:i+1+end])
+			i += end + 2
+		default:
+			j := i
+			for j < len(s) && s[j] != ' ' && s[j] != '\t' {
+				j++
+			}
+			fields = append(fields, s[i:j])
+			i = j
+		}
+	}
+	return fields, nil
+}
+
+// Refs returns all values referenced by the template
+func (t *Template) Refs() []Ref {
+	var refs []Ref
+	for _, n := range t.nodes {
+		if n.isRef {
+			refs = append(refs, n.ref)
+		}
+	}
+	return refs
+}
+
+// Values returns what the placeholders of t expand to with ctx, before
+// escaping. $n beyond the group count, kept as text, has no value.
+func (t *Template) Values(ctx *Context) []string {
+	var values []string
+	for i := range t.nodes {
+		if t.nodes[i].isRef {
+			if value, ok := t.nodes[i].value(ctx); ok {
+				values = append(values, value)
+			}
+		}
+	}
+	return values
+}
+
+// Prefix returns the text of t before its first placeholder
+func (t *Template) Prefix() string {
+	var prefix strings.Builder
+	for _, n := range t.nodes {
+		if n.isRef {
+			break
+		}
+		prefix.WriteString(n.text)
+	}
+	return prefix.String()
+}
+
+func (t *Template) String() string {
+	return t.src
+}
+
+// Expand substitutes placeholders using ctx
+func (t *Template) Expand(ctx *Context) string {
+	def := ctx.Escape
+	if def == "" {
+		def = EscapeQuoted
+	}
+	var out strings.Builder
+	for i := 0; i < len(t.nodes); i++ {
+		n := &t.nodes[i]
+		if !n.isRef {
+			out.WriteString(n.text)
+			continue
+		}
+		value, ok := n.value(ctx)
+		if !ok {
+			// $n beyond the group count is kept as is, like it always was
+			out.WriteString(n.ref.String())
+			continue
+		}
+		if n.mode(def) != EscapeQuoted {
+			out.WriteString(n.escapeValue(value, def))
+			continue
+		}
+		// placeholders next to each other are one value to the command line,
+		// escaped apart a backslash ending one could unescape a quote of the next
+		closing := n.beforeQuote
+		for i+1 < len(t.nodes) && t.nodes[i+1].isRef {
+			next := &t.nodes[i+1]
+			v, ok := next.value(ctx)
+			if !ok {
+				// a kept $n starts with $, not with a quote
+				closing = false
+				break
+			}
+			if next.mode(def) != EscapeQuoted {
+				// it may start with a quote
+				closing = true
+				break
+			}
+			value += v
+			i++
+		}
+		out.WriteString(n.escapeQuoted(value, closing))
+	}
+	return out.String()
+}
+
+// value returns the value of placeholder n, false for $n beyond the group
+// count, which is kept as text
+func (n *node) value(ctx *Context) (string, bool) {
+	value, ok := ctx.lookup(n.ref)
+	if !ok && n.legacy {
+		return "", false
+	}
+	if value == "" && n.hasDef {
+		value = n.def
+	}
+	for _, c := range n.funcs {
+		value = functions[c.name].fn(value, c.args)
+	}
+	return value, true
+}
+
+func (ctx *Context) lookup(ref Ref) (string, bool) {
+	if ref.Group >= 0 {
+		if ref.Group < len(ctx.Matches) {
+			return ctx.Matches[ref.Group], true
+		}
+		return "", false
+	}
+	switch {
+	case ref.Name == "URL":
+		return ctx.URL, true
+	case ref.Name == "URL_RAW":
+		return ctx.URLRaw, true
+	case ref.Name == "URL_DECODED":
+		return ctx.URLDecoded, true
+	case ref.Name == "PROFILE":
+		return ctx.Profile, true
+	case strings.HasPrefix(ref.Name, "URL."):
+		u := ctx.parsedURL()
+		if u == nil {
+			return "", false
+		}
+		component := strings.TrimPrefix(ref.Name, "URL.")
+		if key, ok := strings.CutPrefix(component, "query."); ok {
+			return u.Query().Get(key), true
+		}
+		return urlAccessors[component](u), true
+	}
+	for i, name := range ctx.Names {
+		if name == ref.Name && i < len(ctx.Matches) {
+			return ctx.Matches[i], true
+		}
+	}
+	return "", false
+}
+
+// Expand parses and expands src in one go
+func Expand(src string, ctx *Context) (string, error) {
+	t, err := Parse(src)
+	if err != nil {
+		return "", err
+	}
+	return t.Expand(ctx), nil
+}
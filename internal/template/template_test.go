@@ -0,0 +1,151 @@
+package template
+
+import (
+	"strings"
+	"testing"
+)
+
+func testContext() *Context {
+	return &Context{
+		URL:        "https://www.Example.com:8080/a/b?v=1&q=go+lang#top",
+		URLRaw:     "https://www.Example.com:8080/a/b?v=1&q=go%2Blang#top",
+		URLDecoded: "https://www.Example.com:8080/a/b?v=1&q=go lang#top",
+		Profile:    "work",
+		Matches:    []string{"www.Example.com:8080/a", "Example", "", "a-b"},
+		Names:      []string{"", "site", "user", "slug"},
+		Escape:     EscapeRaw,
+	}
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		// text
+		{"", ""},
+		{"--new-window", "--new-window"},
+		{"{foo} {url} {URLX} {URL", "{foo} {url} {URLX} {URL"},
+		{"$$1 $$", "$1 $"},
+		{"cost: 5$", "cost: 5$"},
+
+		// groups
+		{"$0", "www.Example.com:8080/a"},
+		{"$1/${1}", "Example/Example"},
+		{"${site}", "Example"},
+		{"${slug}", "a-b"},
+		{"${user:-me}", "me"},
+		{"${site:-me}", "Example"},
+		{"${user:-}", ""},
+		{"$9", "$9"},
+		{"${9}", ""},
+		{"${nosuch}", ""},
+		{"$1$3", "Examplea-b"},
+		{"$10", "$10"},
+
+		// the link and its parts
+		{"{URL}", "https://www.Example.com:8080/a/b?v=1&q=go+lang#top"},
+		{"{URL_RAW}", "https://www.Example.com:8080/a/b?v=1&q=go%2Blang#top"},
+		{"{URL_DECODED}", "https://www.Example.com:8080/a/b?v=1&q=go lang#top"},
+		{"{URL.scheme}", "https"},
+		{"{URL.host}", "www.Example.com"},
+		{"{URL.port}", "8080"},
+		{"{URL.path}", "/a/b"},
+		{"{URL.query}", "v=1&q=go+lang"},
+		{"{URL.query.q}", "go lang"},
+		{"{URL.query.none}", ""},
+		{"{URL.fragment}", "top"},
+		{"{URL.user}", ""},
+		{"{PROFILE}", "work"},
+		{"${URL.host}", "www.Example.com"},
+
+		// functions, left to right
+		{"${1|lower}", "example"},
+		{"${1|upper}", "EXAMPLE"},
+		{`{URL.host|trimPrefix "www."}`, "Example.com"},
+		{`{URL.host|trimPrefix "www."|upper}`, "EXAMPLE.COM"},
+		{`{URL.host|upper|trimPrefix "www."}`, "WWW.EXAMPLE.COM"},
+		{`{URL.path|trimSuffix "/b"}`, "/a"},
+		{`${slug|replace "-" "_"}`, "a_b"},
+		{`${slug|replace '-' ' '}`, "a b"},
+		{"{URL.query.q|urlencode}", "go+lang"},
+		{"{URL.query|urldecode}", "v=1&q=go lang"},
+		{"${1|base64}", "RXhhbXBsZQ=="},
+		{`${user:-Me|lower}`, "me"},
+		{`${1|replace "}" "x"}`, "Example"},
+	}
+	for _, tt := range tests {
+		got, err := Expand(tt.src, testContext())
+		if err != nil {
+			t.Errorf("Expand(%q): %v", tt.src, err)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("Expand(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"${1", "unterminated placeholder"},
+		{"{URL|lower", "unterminated placeholder"},
+		{"${}", "empty name"},
+		{"${a b}", "invalid name"},
+		{"{URL.nosuch}", "unknown URL component"},
+		{"${URL_X}", "unknown placeholder"},
+		{"${1|nosuch}", "unknown function"},
+		{"${1|}", "empty function"},
+		{`${1|replace "a"}`, "takes 2 argument(s), got 1"},
+		{"${1|lower x}", "takes 0 argument(s), got 1"},
+		{`${1|trimPrefix "a}`, "unterminated placeholder"},
+		{"${1|raw|lower}", "must be the last element"},
+		{"${1|quoted raw}", "must be the last element"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.src)
+		if err == nil {
+			t.Errorf("Parse(%q) succeeded, want error containing %q", tt.src, tt.want)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("Parse(%q) = %q, want error containing %q", tt.src, err, tt.want)
+		}
+	}
+}
+
+func TestRefs(t *testing.T) {
+	tmpl, err := Parse(`$1 ${site} {URL.host} $$2 {PROFILE}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ref := range tmpl.Refs() {
+		got = append(got, ref.String())
+	}
+	want := "$1 site URL.host PROFILE"
+	if strings.Join(got, " ") != want {
+		t.Errorf("Refs = %v, want %s", got, want)
+	}
+}
+
+func TestExpandWithoutParsedURL(t *testing.T) {
+	ctx := &Context{URL: "::not a url", Escape: EscapeRaw}
+	if got, err := Expand("[{URL.host}]", ctx); err != nil || got != "[]" {
+		t.Errorf("Expand of a URL part of a broken link = %q, %v, want []", got, err)
+	}
+}
+
+func TestValuesAndPrefix(t *testing.T) {
+	tmpl, err := Parse(`logs\${site|lower}-$2 $9 {PROFILE}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(tmpl.Values(testContext()), ","); got != "example,,work" {
+		t.Errorf("Values = %q, want example,,work", got)
+	}
+	if got := tmpl.Prefix(); got != `logs\` {
+		t.Errorf("Prefix = %q, want logs\\", got)
+	}
+}
@@ -0,0 +1,75 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+var (
+	modUser32            = windows.NewLazySystemDLL("user32.dll")
+	procOpenClipboard    = modUser32.NewProc("OpenClipboard")
+	procCloseClipboard   = modUser32.NewProc("CloseClipboard")
+	procEmptyClipboard   = modUser32.NewProc("EmptyClipboard")
+	procSetClipboardData = modUser32.NewProc("SetClipboardData")
+
+	modKernel32      = windows.NewLazySystemDLL("kernel32.dll")
+	procGlobalAlloc  = modKernel32.NewProc("GlobalAlloc")
+	procGlobalFree   = modKernel32.NewProc("GlobalFree")
+	procGlobalLock   = modKernel32.NewProc("GlobalLock")
+	procGlobalUnlock = modKernel32.NewProc("GlobalUnlock")
+	procMoveMemory   = modKernel32.NewProc("RtlMoveMemory")
+)
+
+const (
+	cfUnicodeText = 13
+	gmemMoveable  = 0x0002
+)
+
+// CopyToClipboard puts text on the clipboard
+func CopyToClipboard(text string) error {
+	data, err := windows.UTF16FromString(text)
+	if err != nil {
+		return err
+	}
+
+	// another program may hold the clipboard for a moment
+	opened := false
+	for range 10 {
+		if r, _, _ := procOpenClipboard.Call(0); r != 0 {
+			opened = true
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if !opened {
+		return errors.New("clipboard is busy")
+	}
+	defer procCloseClipboard.Call()
+
+	if r, _, err := procEmptyClipboard.Call(); r == 0 {
+		return fmt.Errorf("can't empty clipboard: %w", err)
+	}
+	size := uintptr(len(data)) * unsafe.Sizeof(data[0])
+	mem, _, err := procGlobalAlloc.Call(gmemMoveable, size)
+	if mem == 0 {
+		return fmt.Errorf("can't allocate clipboard memory: %w", err)
+	}
+	ptr, _, err := procGlobalLock.Call(mem)
+	if ptr == 0 {
+		procGlobalFree.Call(mem)
+		return fmt.Errorf("can't lock clipboard memory: %w", err)
+	}
+	procMoveMemory.Call(ptr, uintptr(unsafe.Pointer(&data[0])), size)
+	procGlobalUnlock.Call(mem)
+
+	if r, _, err := procSetClipboardData.Call(cfUnicodeText, mem); r == 0 {
+		procGlobalFree.Call(mem)
+		return fmt.Errorf("can't set clipboard data: %w", err)
+	}
+	// the clipboard owns mem now
+	return nil
+}